@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/zenreach/hydroponics/internal/auth"
+)
+
+// newAuthenticators returns the authenticators for the configured credential
+// sources. Requests are not authenticated if none are configured.
+func newAuthenticators(cfg *config) ([]auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+	if cfg.AuthTokensFile != "" {
+		tokens, err := auth.LoadTokens(cfg.AuthTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if cfg.AuthHtpasswdFile != "" {
+		passwords, err := auth.LoadHtpasswd(cfg.AuthHtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, passwords)
+	}
+	if cfg.TLSClientCAFile != "" {
+		authenticators = append(authenticators, auth.NewClientCerts(cfg.AuthClientSubjects))
+	}
+	return authenticators, nil
+}
+
+// hasAuth returns true if an authentication method is configured.
+func (c *config) hasAuth() bool {
+	return c.AuthTokensFile != "" || c.AuthHtpasswdFile != "" || c.TLSClientCAFile != ""
+}
+
+// newRoles returns the permissions of each principal. Every principal is
+// given the default permissions unless it is listed in AUTH_PERMISSIONS_FILE.
+func newRoles(cfg *config) (*auth.Roles, error) {
+	if cfg.AuthPermissionsFile == "" {
+		return auth.NewRoles(nil, cfg.defaultPerms), nil
+	}
+	return auth.LoadRoles(cfg.AuthPermissionsFile, cfg.defaultPerms)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/coalesce"
+	"github.com/zenreach/hydroponics/internal/cache/disk"
+	"github.com/zenreach/hydroponics/internal/cache/httphandler"
+	"github.com/zenreach/hydroponics/internal/cache/memory"
+	"github.com/zenreach/hydroponics/internal/cache/negative"
+	"github.com/zenreach/hydroponics/internal/cache/s3"
+	"github.com/zenreach/hydroponics/internal/cache/spool"
+	"github.com/zenreach/hydroponics/internal/cache/tiered"
+)
+
+const (
+	tierMemory = "memory"
+	tierDisk   = "disk"
+	tierS3     = "s3"
+)
+
+// instanceName matches the names of instances. Names are one or more path
+// segments.
+var instanceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(/[A-Za-z0-9][A-Za-z0-9._-]*)*$`)
+
+// instance is a named CAS and AC served under /<name>/cas/ and /<name>/ac/.
+type instance struct {
+	Name string
+	// Bucket and Prefix locate the instance in its own bucket. The instance
+	// is stored under its name within the CAS and AC prefixes if Bucket is
+	// empty.
+	Bucket string
+	Prefix string
+}
+
+// parseInstance parses an instance of the form name, name=bucket, or
+// name=bucket/prefix.
+func parseInstance(value string) (instance, error) {
+	var inst instance
+	parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+	inst.Name = parts[0]
+	if !instanceName.MatchString(inst.Name) {
+		return inst, fmt.Errorf("invalid instance name %q", inst.Name)
+	}
+	if len(parts) == 2 {
+		location := strings.SplitN(parts[1], "/", 2)
+		inst.Bucket = location[0]
+		if inst.Bucket == "" {
+			return inst, fmt.Errorf("empty bucket for instance %q", inst.Name)
+		}
+		if len(location) == 2 {
+			inst.Prefix = location[1]
+		}
+	}
+	return inst, nil
+}
+
+// namespaces returns the CAS and AC namespaces of the instance.
+func (i instance) namespaces(cfg *config) (cas, ac namespace) {
+	cas.Name = path.Join(i.Name, "cas")
+	cas.ContentAddressed = true
+	ac.Name = path.Join(i.Name, "ac")
+	if i.Bucket == "" {
+		cas.Bucket, cas.Prefix = cfg.CASBucket, path.Join(cfg.CASPrefix, i.Name)
+		ac.Bucket, ac.Prefix = cfg.ACBucket, path.Join(cfg.ACPrefix, i.Name)
+	} else {
+		cas.Bucket, cas.Prefix = i.Bucket, path.Join(i.Prefix, "cas")
+		ac.Bucket, ac.Prefix = i.Bucket, path.Join(i.Prefix, "ac")
+	}
+	return cas, ac
+}
+
+// newInstances builds the caches of each configured instance. The stacks are
+// returned so that they may be shut down.
+func newInstances(cfg *config, local *localTiers, logger hatchet.Logger) ([]httphandler.Instance, []*stack, error) {
+	var instances []httphandler.Instance
+	var stacks []*stack
+	for _, inst := range cfg.instances {
+		casNS, acNS := inst.namespaces(cfg)
+		cas, err := newStack(cfg, casNS, local, logger)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "instance %s", inst.Name)
+		}
+		ac, err := newStack(cfg, acNS, local, logger)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "instance %s", inst.Name)
+		}
+		stacks = append(stacks, cas, ac)
+		instances = append(instances, httphandler.Instance{
+			Name: inst.Name,
+			CAS:  cas,
+			AC:   ac,
+		})
+	}
+	return instances, stacks, nil
+}
+
+// namespace identifies one of the caches served by s3cache.
+type namespace struct {
+	Name   string
+	Bucket string
+	Prefix string
+	// ContentAddressed is set for the CAS as its keys identify its objects.
+	ContentAddressed bool
+}
+
+// localTiers are the memory and disk tiers shared by every namespace so that
+// MEMORY_CACHE_SIZE and DISK_CACHE_SIZE bound the total size of the objects
+// kept by s3cache. Each namespace stores its objects under its name.
+type localTiers struct {
+	memory cache.Cache
+	disk   cache.Cache
+}
+
+// newLocalTiers builds the configured memory and disk tiers.
+func newLocalTiers(cfg *config) (*localTiers, error) {
+	local := &localTiers{}
+	if cfg.hasTier(tierMemory) {
+		local.memory = memory.New(cfg.MemoryCacheSize, cfg.MemoryCacheMaxObject)
+	}
+	if cfg.hasTier(tierDisk) {
+		c, err := disk.New(cfg.DiskCacheDir, cfg.DiskCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		local.disk = c
+	}
+	return local, nil
+}
+
+// scoped stores the objects of a namespace in a cache shared by several
+// namespaces. Keys are prefixed with the namespace name.
+type scoped struct {
+	cache  cache.Cache
+	prefix string
+}
+
+func scope(c cache.Cache, ns namespace) *scoped {
+	return &scoped{
+		cache:  c,
+		prefix: ns.Name + "/",
+	}
+}
+
+func (s *scoped) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.cache.Get(ctx, s.prefix+key)
+}
+
+func (s *scoped) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return cache.GetRange(ctx, s.cache, s.prefix+key, offset, length)
+}
+
+func (s *scoped) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	return s.cache.Stat(ctx, s.prefix+key)
+}
+
+func (s *scoped) Put(ctx context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
+	return s.cache.Put(ctx, s.prefix+key, rdr, meta)
+}
+
+func (s *scoped) MaxObjectSize() int64 {
+	if bounded, ok := s.cache.(cache.Bounded); ok {
+		return bounded.MaxObjectSize()
+	}
+	return math.MaxInt64
+}
+
+type shutdowner interface {
+	Shutdown(context.Context) error
+}
+
+// stack is a cache built from the configured tiers.
+type stack struct {
+	cache.Cache
+	shutdown []shutdowner
+}
+
+// newStack builds a cache for the namespace from the configured tiers. The
+// memory and disk tiers are shared with the other namespaces.
+func newStack(cfg *config, ns namespace, local *localTiers, logger hatchet.Logger) (*stack, error) {
+	s := &stack{}
+	var tiers []cache.Cache
+	for _, name := range cfg.CacheTiers {
+		switch strings.TrimSpace(name) {
+		case tierMemory:
+			tiers = append(tiers, scope(local.memory, ns))
+		case tierDisk:
+			tiers = append(tiers, scope(local.disk, ns))
+		case tierS3:
+			c, err := s3.New(s3.Config{
+				Bucket:             ns.Bucket,
+				Prefix:             ns.Prefix,
+				Namespace:          ns.Name,
+				BufferSize:         cfg.S3BufferSize,
+				Endpoint:           cfg.S3Endpoint,
+				Region:             cfg.S3Region,
+				PathStyle:          cfg.S3PathStyle,
+				CAFile:             cfg.S3CAFile,
+				InsecureSkipVerify: cfg.S3InsecureSkipVerify,
+				ShardDepth:         cfg.S3ShardDepth,
+				RefreshAge:         cfg.S3RefreshAge,
+				RefreshConcurrency: cfg.S3RefreshConcurrency,
+				RefreshRate:        cfg.S3RefreshRate,
+				Retries:            cfg.S3Retries,
+				RetryBaseDelay:     cfg.S3RetryBaseDelay,
+				RetryMaxDelay:      cfg.S3RetryMaxDelay,
+				BreakerThreshold:   cfg.S3BreakerThreshold,
+				BreakerCooldown:    cfg.S3BreakerCooldown,
+			}, logger)
+			if err != nil {
+				return nil, err
+			}
+			var tier cache.Cache = c
+			if cfg.SpoolDir != "" {
+				sp, err := spool.New(c, spool.Config{
+					Dir:         filepath.Join(cfg.SpoolDir, ns.Name),
+					Concurrency: cfg.SpoolConcurrency,
+					MaxSize:     cfg.SpoolMaxSize,
+				}, logger)
+				if err != nil {
+					return nil, err
+				}
+				// spooled uploads must finish before S3 is shut down
+				s.shutdown = append(s.shutdown, sp)
+				tier = sp
+			}
+			tiers = append(tiers, tier)
+			s.shutdown = append(s.shutdown, c)
+		default:
+			return nil, fmt.Errorf("unknown cache tier %q", name)
+		}
+	}
+
+	switch len(tiers) {
+	case 0:
+		return nil, fmt.Errorf("no cache tiers configured")
+	case 1:
+		s.Cache = tiers[0]
+	default:
+		policy, err := parsePolicy(cfg.WritePolicy)
+		if err != nil {
+			return nil, err
+		}
+		c := tiered.New(tiers, policy, logger)
+		s.Cache = c
+		// background writes must finish before the tiers are shut down
+		s.shutdown = append([]shutdowner{c}, s.shutdown...)
+	}
+
+	if cfg.Coalesce {
+		s.Cache = coalesce.New(s.Cache, coalesce.Config{
+			BufferSize:       cfg.CoalesceBufferSize,
+			Timeout:          cfg.Timeout,
+			ContentAddressed: ns.ContentAddressed,
+		})
+	}
+	if cfg.NegativeCacheTTL > 0 {
+		s.Cache = negative.New(s.Cache, negative.Config{
+			TTL:        cfg.NegativeCacheTTL,
+			MaxEntries: cfg.NegativeCacheSize,
+		})
+	}
+	return s, nil
+}
+
+// Shutdown each of the tiers which run in the background. The first error is
+// returned.
+func (s *stack) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, c := range s.shutdown {
+		err := c.Shutdown(ctx)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// parsePolicy parses a tiered cache write policy.
+func parsePolicy(policy string) (tiered.Policy, error) {
+	switch policy {
+	case "write-through":
+		return tiered.WriteThrough, nil
+	case "write-back":
+		return tiered.WriteBack, nil
+	}
+	return 0, fmt.Errorf("unknown write policy %q", policy)
+}
+
+// hasTier returns true if the named tier is configured.
+func (c *config) hasTier(name string) bool {
+	for _, tier := range c.CacheTiers {
+		if strings.TrimSpace(tier) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,23 +1,187 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/caarlos0/env"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	"github.com/zenreach/hydroponics/internal/digest"
 )
 
 type config struct {
-	CASBucket string        `env:"CAS_BUCKET,required"`
-	CASPrefix string        `env:"CAS_PREFIX"`
-	ACBucket  string        `env:"AC_BUCKET,required"`
-	ACPrefix  string        `env:"AC_PREFIX"`
-	Timeout   time.Duration `env:"S3_TIMEOUT"`
-	Listen    string        `env:"LISTEN" envDefault:":http"`
-	LogLevel  string        `env:"LOG_LEVEL" envDefault:"info"`
+	CacheTiers           []string      `env:"CACHE_TIERS" envDefault:"s3" envSeparator:","`
+	WritePolicy          string        `env:"WRITE_POLICY" envDefault:"write-through"`
+	MemoryCacheSize      int64         `env:"MEMORY_CACHE_SIZE" envDefault:"1073741824"`
+	MemoryCacheMaxObject int64         `env:"MEMORY_CACHE_MAX_OBJECT_SIZE" envDefault:"67108864"`
+	DiskCacheDir         string        `env:"DISK_CACHE_DIR"`
+	DiskCacheSize        int64         `env:"DISK_CACHE_SIZE" envDefault:"10737418240"`
+	Coalesce             bool          `env:"COALESCE" envDefault:"true"`
+	CoalesceBufferSize   int           `env:"COALESCE_BUFFER_SIZE"`
+	NegativeCacheTTL     time.Duration `env:"NEGATIVE_CACHE_TTL"`
+	NegativeCacheSize    int           `env:"NEGATIVE_CACHE_SIZE"`
+	SpoolDir             string        `env:"SPOOL_DIR"`
+	SpoolConcurrency     int           `env:"SPOOL_CONCURRENCY"`
+	SpoolMaxSize         int64         `env:"SPOOL_MAX_SIZE"`
+	CASBucket            string        `env:"CAS_BUCKET"`
+	CASPrefix            string        `env:"CAS_PREFIX"`
+	ACBucket             string        `env:"AC_BUCKET"`
+	ACPrefix             string        `env:"AC_PREFIX"`
+	CASCodec             string        `env:"CAS_CODEC" envDefault:"gzip"`
+	CASCodecLevel        int           `env:"CAS_CODEC_LEVEL"`
+	ACCodec              string        `env:"AC_CODEC" envDefault:"gzip"`
+	ACCodecLevel         int           `env:"AC_CODEC_LEVEL"`
+	Instances            []string      `env:"INSTANCES" envSeparator:","`
+	Timeout              time.Duration `env:"S3_TIMEOUT"`
+	DigestFunction       string        `env:"DIGEST_FUNCTION" envDefault:"sha256"`
+	S3Endpoint           string        `env:"S3_ENDPOINT"`
+	S3Region             string        `env:"S3_REGION"`
+	S3PathStyle          bool          `env:"S3_PATH_STYLE"`
+	S3CAFile             string        `env:"S3_CA_FILE"`
+	S3InsecureSkipVerify bool          `env:"S3_INSECURE_SKIP_VERIFY"`
+	S3BufferSize         int           `env:"S3_BUFFER_SIZE"`
+	S3ShardDepth         int           `env:"S3_SHARD_DEPTH"`
+	S3RefreshAge         time.Duration `env:"S3_REFRESH_AGE"`
+	S3RefreshConcurrency int           `env:"S3_REFRESH_CONCURRENCY"`
+	S3RefreshRate        float64       `env:"S3_REFRESH_RATE"`
+	S3Retries            int           `env:"S3_RETRIES"`
+	S3RetryBaseDelay     time.Duration `env:"S3_RETRY_BASE_DELAY"`
+	S3RetryMaxDelay      time.Duration `env:"S3_RETRY_MAX_DELAY"`
+	S3BreakerThreshold   int           `env:"S3_BREAKER_THRESHOLD"`
+	S3BreakerCooldown    time.Duration `env:"S3_BREAKER_COOLDOWN"`
+	BufferSize           int           `env:"BUFFER_SIZE"`
+	Listen               []string      `env:"LISTEN" envDefault:":http" envSeparator:","`
+	H2C                  bool          `env:"H2C"`
+	TLSCertFile          string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile           string        `env:"TLS_KEY_FILE"`
+	TLSClientCAFile      string        `env:"TLS_CLIENT_CA_FILE"`
+	AuthTokensFile       string        `env:"AUTH_TOKENS_FILE"`
+	AuthHtpasswdFile     string        `env:"AUTH_HTPASSWD_FILE"`
+	AuthClientSubjects   []string      `env:"AUTH_CLIENT_SUBJECTS" envSeparator:","`
+	AuthPermissionsFile  string        `env:"AUTH_PERMISSIONS_FILE"`
+	AuthDefaultPerms     string        `env:"AUTH_DEFAULT_PERMISSIONS" envDefault:"all"`
+	GRPCListen           string        `env:"GRPC_LISTEN"`
+	UploadDir            string        `env:"UPLOAD_DIR"`
+	PipelineHeader       string        `env:"METRICS_PIPELINE_HEADER"`
+	TraceExporter        string        `env:"TRACE_EXPORTER"`
+	TraceFile            string        `env:"TRACE_FILE"`
+	TraceSampleRatio     float64       `env:"TRACE_SAMPLE_RATIO" envDefault:"1"`
+	LogLevel             string        `env:"LOG_LEVEL" envDefault:"info"`
+
+	// digest is the parsed DigestFunction.
+	digest *digest.Function
+
+	// defaultPerms is the parsed AuthDefaultPerms.
+	defaultPerms auth.Permission
+
+	// listeners are the parsed Listen addresses.
+	listeners []listenAddr
+
+	// grpcListener is the parsed GRPCListen address.
+	grpcListener listenAddr
+
+	// instances are the parsed Instances.
+	instances []instance
+
+	// casCodec and acCodec are the parsed CASCodec and ACCodec.
+	casCodec *codec.Codec
+	acCodec  *codec.Codec
 }
 
 func parseConfig() (*config, error) {
 	cfg := &config{}
 	err := env.Parse(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.hasTier(tierS3) {
+		if cfg.CASBucket == "" {
+			return cfg, errors.New("CAS_BUCKET is required by the s3 cache tier")
+		}
+		if cfg.ACBucket == "" {
+			return cfg, errors.New("AC_BUCKET is required by the s3 cache tier")
+		}
+	}
+	if cfg.hasTier(tierDisk) && cfg.DiskCacheDir == "" {
+		return cfg, errors.New("DISK_CACHE_DIR is required by the disk cache tier")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return cfg, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE")
+	}
+	names := map[string]bool{}
+	for _, value := range cfg.Instances {
+		inst, err := parseInstance(value)
+		if err != nil {
+			return cfg, err
+		}
+		if names[inst.Name] {
+			return cfg, fmt.Errorf("duplicate instance %q", inst.Name)
+		}
+		names[inst.Name] = true
+		cfg.instances = append(cfg.instances, inst)
+	}
+	for _, value := range cfg.Listen {
+		addr, err := parseListen(value, cfg.TLSCertFile != "")
+		if err != nil {
+			return cfg, err
+		}
+		cfg.listeners = append(cfg.listeners, addr)
+	}
+	if len(cfg.listeners) == 0 {
+		return cfg, errors.New("LISTEN requires at least one address")
+	}
+	if cfg.GRPCListen != "" {
+		cfg.grpcListener, err = parseListen(cfg.GRPCListen, cfg.TLSCertFile != "")
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if len(cfg.AuthClientSubjects) > 0 && cfg.TLSClientCAFile == "" {
+		return cfg, errors.New("AUTH_CLIENT_SUBJECTS requires TLS_CLIENT_CA_FILE")
+	}
+	if cfg.AuthPermissionsFile != "" && !cfg.hasAuth() {
+		return cfg, errors.New("AUTH_PERMISSIONS_FILE requires an authentication method")
+	}
+	cfg.defaultPerms, err = auth.ParsePermission(cfg.AuthDefaultPerms)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.digest, err = digest.Parse(cfg.DigestFunction)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.casCodec, err = parseCodec(cfg.CASCodec, cfg.CASCodecLevel)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid CAS_CODEC: %s", err)
+	}
+	cfg.acCodec, err = parseCodec(cfg.ACCodec, cfg.ACCodecLevel)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid AC_CODEC: %s", err)
+	}
+	_, err = parsePolicy(cfg.WritePolicy)
 	return cfg, err
 }
+
+// parseCodec returns the codec of an encoding name and compression level.
+func parseCodec(name string, level int) (*codec.Codec, error) {
+	switch name {
+	case "none":
+		name = codec.Identity
+	case "gzip":
+		name = codec.Gzip
+	case "zstd":
+		name = codec.Zstd
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return codec.New(codec.Config{
+		Encoding: name,
+		Level:    level,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/httphandler"
+	"github.com/zenreach/hydroponics/internal/cache/reapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcServer serves the remote execution API cache services.
+type grpcServer struct {
+	server *grpc.Server
+	api    *reapi.Server
+}
+
+// startGRPC starts a gRPC server for the remote execution API cache services
+// on the configured address. The instances are served under their names as
+// they are by the HTTP handler. The server uses TLS as the HTTP listeners do
+// and authenticates calls if any authenticators are given.
+func startGRPC(cfg *config, cas, ac cache.Cache, instances []httphandler.Instance, tlsConfig *tls.Config, authenticators []auth.Authenticator, roles *auth.Roles, logger hatchet.Logger) (*grpcServer, error) {
+	// TLS is handled by the gRPC transport credentials
+	addr := cfg.grpcListener
+	addr.tls = false
+	listener, err := listen(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []grpc.ServerOption
+	if cfg.grpcListener.tls {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if len(authenticators) > 0 {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(auth.UnaryServerInterceptor(authenticators, roles, logger)),
+			grpc.ChainStreamInterceptor(auth.StreamServerInterceptor(authenticators, roles, logger)),
+		)
+	}
+
+	var apiInstances []reapi.Instance
+	for _, inst := range instances {
+		apiInstances = append(apiInstances, reapi.Instance{
+			Name: inst.Name,
+			CAS:  inst.CAS,
+			AC:   inst.AC,
+		})
+	}
+
+	s := &grpcServer{
+		server: grpc.NewServer(opts...),
+		api: reapi.New(cas, ac, reapi.Config{
+			Timeout:    cfg.Timeout,
+			BufferSize: cfg.BufferSize,
+			UploadDir:  cfg.UploadDir,
+			Digest:     cfg.digest,
+			CASCodec:   cfg.casCodec,
+			ACCodec:    cfg.acCodec,
+			Instances:  apiInstances,
+		}, logger),
+	}
+	s.api.Register(s.server)
+
+	logger.Log(hatchet.L{
+		"message": "start grpc server",
+		"level":   "info",
+		"address": cfg.grpcListener.String(),
+	})
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil {
+			logError(logger, err, "grpc server failure")
+		}
+	}()
+	return s, nil
+}
+
+// Stop gracefully stops the gRPC server. Remaining connections are closed
+// when the context expires. Partial uploads are discarded.
+func (s *grpcServer) Stop(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.server.Stop()
+	}
+	s.api.Close()
+}
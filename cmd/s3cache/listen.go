@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenreach/hatchet"
+)
+
+// certCheckInterval is how often the server certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// listenAddr is an address the HTTP server listens on.
+type listenAddr struct {
+	network string // tcp or unix
+	address string
+	tls     bool
+}
+
+func (a listenAddr) String() string {
+	switch {
+	case a.network == "unix":
+		return "unix:" + a.address
+	case a.tls:
+		return "tls://" + a.address
+	}
+	return "tcp://" + a.address
+}
+
+// parseListen parses a listen address. Addresses are one of:
+//
+//	host:port           TLS if a server certificate is configured
+//	tcp://host:port     plain TCP
+//	tls://host:port     TLS
+//	unix:/path/to/sock  Unix domain socket
+func parseListen(value string, useTLS bool) (listenAddr, error) {
+	value = strings.TrimSpace(value)
+	addr := listenAddr{network: "tcp", tls: useTLS}
+	switch {
+	case strings.HasPrefix(value, "unix:"):
+		addr.network = "unix"
+		addr.address = strings.TrimPrefix(strings.TrimPrefix(value, "unix:"), "//")
+		addr.tls = false
+	case strings.HasPrefix(value, "tcp://"):
+		addr.address = strings.TrimPrefix(value, "tcp://")
+		addr.tls = false
+	case strings.HasPrefix(value, "tls://"):
+		if !useTLS {
+			return addr, fmt.Errorf("listen address %s requires TLS_CERT_FILE", value)
+		}
+		addr.address = strings.TrimPrefix(value, "tls://")
+	case strings.Contains(value, "://"):
+		return addr, fmt.Errorf("unknown scheme in listen address %s", value)
+	default:
+		addr.address = value
+	}
+	if addr.address == "" {
+		return addr, fmt.Errorf("empty listen address %q", value)
+	}
+	return addr, nil
+}
+
+// listen opens a listener on the address. A stale socket left by a previous
+// process is removed before listening on a Unix domain socket.
+func listen(addr listenAddr, tlsConfig *tls.Config) (net.Listener, error) {
+	if addr.network == "unix" {
+		if info, err := os.Stat(addr.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr.address)
+		}
+	}
+	l, err := net.Listen(addr.network, addr.address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.tls {
+		config := tlsConfig.Clone()
+		// enable HTTP/2 over TLS
+		config.NextProtos = []string{"h2", "http/1.1"}
+		l = tls.NewListener(l, config)
+	}
+	return l, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the HTTP server. The
+// certificate is reloaded when its files change. Client certificates are
+// verified against TLS_CLIENT_CA_FILE when it is set. They are optional so
+// that clients may authenticate by other means.
+func serverTLSConfig(cfg *config, logger hatchet.Logger) (*tls.Config, error) {
+	cert, err := loadCertificate(cfg.TLSCertFile, cfg.TLSKeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: cert.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// certificate is a server certificate which is reloaded when its files
+// change so that it may be rotated without a restart.
+type certificate struct {
+	certFile string
+	keyFile  string
+	logger   hatchet.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func loadCertificate(certFile, keyFile string, logger hatchet.Logger) (*certificate, error) {
+	c := &certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	modTime, err := c.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	return c, nil
+}
+
+// GetCertificate returns the current certificate. The files are checked for
+// changes at most once per certCheckInterval. The previous certificate is
+// kept if the new one fails to load, such as while the files are being
+// replaced.
+func (c *certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+
+	modTime, err := c.lastModified()
+	if err != nil || !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		logError(c.logger, err, "failed to reload tls certificate")
+		return c.cert, nil
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.logger.Log(hatchet.L{
+		"message": "reloaded tls certificate",
+		"level":   "info",
+		"file":    c.certFile,
+	})
+	return c.cert, nil
+}
+
+// lastModified returns the latest modification time of the certificate and
+// key files.
+func (c *certificate) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// serve serves HTTP requests on each listener until the server is shut down.
+// The first error returned by a listener is sent on the returned channel.
+func serve(server *http.Server, listeners []net.Listener) <-chan error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+	return errs
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/auth"
 	"github.com/zenreach/hydroponics/internal/cache/httphandler"
-	"github.com/zenreach/hydroponics/internal/cache/s3"
 	"github.com/zenreach/hydroponics/internal/signals"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func run() int {
@@ -23,22 +28,105 @@ func run() int {
 	logger = newLogger(cfg.LogLevel)
 	defer logger.Close()
 
-	cas, err := s3.New(cfg.CASBucket, cfg.CASPrefix, logger)
+	stopTracing, err := startTracing(cfg)
 	if err != nil {
-		logError(logger, err, "failed to init ac cache")
+		logError(logger, err, "failed to start tracing")
+		return 1
+	}
+
+	local, err := newLocalTiers(cfg)
+	if err != nil {
+		logError(logger, err, "failed to init local cache tiers")
 		return 1
 	}
 
-	ac, err := s3.New(cfg.ACBucket, cfg.ACPrefix, logger)
+	cas, err := newStack(cfg, namespace{
+		Name:             "cas",
+		Bucket:           cfg.CASBucket,
+		Prefix:           cfg.CASPrefix,
+		ContentAddressed: true,
+	}, local, logger)
+	if err != nil {
+		logError(logger, err, "failed to init cas cache")
+		return 1
+	}
+
+	ac, err := newStack(cfg, namespace{
+		Name:   "ac",
+		Bucket: cfg.ACBucket,
+		Prefix: cfg.ACPrefix,
+	}, local, logger)
 	if err != nil {
 		logError(logger, err, "failed to init ac cache")
 		return 1
 	}
 
-	handler := httphandler.New(cas, ac, cfg.Timeout, logger)
+	instances, stacks, err := newInstances(cfg, local, logger)
+	if err != nil {
+		logError(logger, err, "failed to init instance caches")
+		return 1
+	}
+	stacks = append([]*stack{cas, ac}, stacks...)
+
+	handler := httphandler.New(cas, ac, httphandler.Config{
+		Timeout:        cfg.Timeout,
+		BufferSize:     cfg.BufferSize,
+		UploadDir:      cfg.UploadDir,
+		Digest:         cfg.digest,
+		PipelineHeader: cfg.PipelineHeader,
+		Instances:      instances,
+		CASCodec:       cfg.casCodec,
+		ACCodec:        cfg.acCodec,
+	}, logger)
+	authenticators, err := newAuthenticators(cfg)
+	if err != nil {
+		logError(logger, err, "failed to load credentials")
+		return 1
+	}
+	roles, err := newRoles(cfg)
+	if err != nil {
+		logError(logger, err, "failed to load permissions")
+		return 1
+	}
+	if len(authenticators) > 0 {
+		handler = auth.Handler(handler, authenticators, roles, logger)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", handler)
 	server := &http.Server{
-		Addr:    cfg.Listen,
-		Handler: handler,
+		Handler: mux,
+	}
+	if cfg.H2C {
+		// accept HTTP/2 without TLS
+		server.Handler = h2c.NewHandler(mux, &http2.Server{})
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" {
+		tlsConfig, err = serverTLSConfig(cfg, logger)
+		if err != nil {
+			logError(logger, err, "failed to load tls config")
+			return 1
+		}
+	}
+	var listeners []net.Listener
+	for _, addr := range cfg.listeners {
+		l, err := listen(addr, tlsConfig)
+		if err != nil {
+			logError(logger, err, "failed to listen on "+addr.String())
+			return 1
+		}
+		listeners = append(listeners, l)
+	}
+
+	var rpc *grpcServer
+	if cfg.GRPCListen != "" {
+		rpc, err = startGRPC(cfg, cas, ac, instances, tlsConfig, authenticators, roles, logger)
+		if err != nil {
+			logError(logger, err, "failed to start grpc server")
+			return 1
+		}
 	}
 
 	shutdown := make(chan error, 1)
@@ -55,22 +143,39 @@ func run() int {
 
 		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 
-		err := server.Shutdown(ctx)
-		if err != nil {
-			shutdown <- err
+		if rpc != nil {
+			logger.Log(hatchet.L{
+				"message": "stop grpc server",
+				"level":   "info",
+				"address": cfg.grpcListener.String(),
+			})
+			rpc.Stop(ctx)
 		}
 
-		err = cas.Shutdown(ctx)
-		if err != nil {
-			shutdown <- err
+		// every stack is shut down even if another fails so that spooled
+		// uploads are drained; the first error is reported
+		var firstErr error
+		report := func(err error) {
+			if err == nil {
+				return
+			}
+			if firstErr == nil {
+				firstErr = err
+			} else {
+				logError(logger, err, "shutdown error")
+			}
 		}
 
-		err = ac.Shutdown(ctx)
-		if err != nil {
-			shutdown <- err
+		report(server.Shutdown(ctx))
+		for _, s := range stacks {
+			report(s.Shutdown(ctx))
 		}
+		report(stopTracing(ctx))
 
 		cancel()
+		if firstErr != nil {
+			shutdown <- firstErr
+		}
 		close(shutdown)
 	}()
 
@@ -80,13 +185,16 @@ func run() int {
 		"config":  cfg,
 	})
 
-	logger.Log(hatchet.L{
-		"message": "start http server",
-		"level":   "info",
-		"address": cfg.Listen,
-	})
+	for _, addr := range cfg.listeners {
+		logger.Log(hatchet.L{
+			"message": "start http server",
+			"level":   "info",
+			"address": addr.String(),
+		})
+	}
 
-	err = server.ListenAndServe()
+	// every listener stops when the server is shut down
+	err = <-serve(server, listeners)
 	if err == http.ErrServerClosed {
 		// wait for shutdown to finish
 		err = <-shutdown
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// startTracing configures the global tracer provider with the configured
+// exporter. The returned function flushes pending spans and stops the
+// exporter. Tracing is disabled if no exporter is configured.
+func startTracing(cfg *config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch cfg.TraceExporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		// the endpoint is configured by the standard OTEL_EXPORTER_OTLP_*
+		// environment variables
+		exporter, err = otlptracegrpc.New(context.Background())
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "file":
+		if cfg.TraceFile == "" {
+			return nil, fmt.Errorf("TRACE_FILE is required by the file trace exporter")
+		}
+		file, err = os.OpenFile(cfg.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.TraceExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "s3cache"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
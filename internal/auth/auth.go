@@ -0,0 +1,176 @@
+// Package auth authenticates requests to the cache HTTP and gRPC APIs.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/zenreach/hatchet"
+)
+
+// Realm is the protection space sent in authentication challenges.
+const Realm = "s3cache"
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request does
+	// not carry the kind of credentials it checks.
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrInvalidCredentials is returned by an Authenticator when the request
+	// carries credentials which are not valid.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrForbidden is returned by an Authenticator when the request carries
+	// valid credentials which are not allowed access.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Authenticator checks the credentials of a request.
+type Authenticator interface {
+	// Authenticate returns the name of the principal which made the request.
+	// ErrNoCredentials is returned if the request does not carry credentials
+	// of the kind checked by the authenticator.
+	Authenticate(r *http.Request) (string, error)
+
+	// Challenge returns the WWW-Authenticate challenge sent when a request is
+	// not authenticated. It is empty if the authenticator has none.
+	Challenge() string
+}
+
+type principalKey struct{}
+
+// identity is the authenticated principal of a request.
+type identity struct {
+	name        string
+	permissions Permission
+}
+
+// Principal returns the name of the authenticated principal stored in the
+// context by Handler or the gRPC interceptors. It is empty if the request was
+// not authenticated.
+func Principal(ctx context.Context) string {
+	id, _ := ctx.Value(principalKey{}).(identity)
+	return id.name
+}
+
+// NewContext returns a copy of ctx which carries the principal and its
+// permissions as though it had been authenticated.
+func NewContext(ctx context.Context, name string, permissions Permission) context.Context {
+	return context.WithValue(ctx, principalKey{}, identity{
+		name:        name,
+		permissions: permissions,
+	})
+}
+
+// Handler returns a handler which only passes requests accepted by one of the
+// authenticators to h. Requests without valid credentials are rejected with
+// 401 Unauthorized and a challenge from each authenticator. Requests with
+// valid credentials which are not allowed access are rejected with 403
+// Forbidden. The principal and its permissions from roles are stored in the
+// request context. Every principal is given all permissions if roles is nil.
+func Handler(h http.Handler, authenticators []Authenticator, roles *Roles, logger hatchet.Logger) http.Handler {
+	return &handler{
+		next:           h,
+		authenticators: authenticators,
+		roles:          roles,
+		logger:         logger,
+	}
+}
+
+type handler struct {
+	next           http.Handler
+	authenticators []Authenticator
+	roles          *Roles
+	logger         hatchet.Logger
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := authenticate(r, h.authenticators, h.roles)
+	if err == nil {
+		ctx := context.WithValue(r.Context(), principalKey{}, id)
+		h.next.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+	h.logDebug(err, r, "authentication failed")
+
+	if err == ErrForbidden {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	for _, authn := range h.authenticators {
+		if challenge := authn.Challenge(); challenge != "" {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// authenticate returns the identity of the principal which made the request
+// if one of the authenticators accepts it. Otherwise ErrForbidden is returned
+// if any authenticator forbids the principal, followed by the error of an
+// authenticator which rejected invalid credentials, or ErrNoCredentials.
+func authenticate(r *http.Request, authenticators []Authenticator, roles *Roles) (identity, error) {
+	var denied error
+	for _, authn := range authenticators {
+		name, err := authn.Authenticate(r)
+		if err == nil {
+			return identity{
+				name:        name,
+				permissions: roles.Permissions(name),
+			}, nil
+		}
+		// a forbidden principal takes precedence over invalid credentials
+		if err != ErrNoCredentials && denied != ErrForbidden {
+			denied = err
+		}
+	}
+	if denied == nil {
+		denied = ErrNoCredentials
+	}
+	return identity{}, denied
+}
+
+func (h *handler) logDebug(err error, r *http.Request, msg string) {
+	h.logger.Log(hatchet.L{
+		"message": msg,
+		"level":   "debug",
+		"error":   err,
+		"remote":  r.RemoteAddr,
+		"path":    r.URL.Path,
+	})
+}
+
+// readEntries reads the name:value entries from a credentials file. Blank
+// lines and lines starting with # are ignored.
+func readEntries(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:value", filename, line)
+		}
+		if _, ok := entries[parts[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate name %q", filename, line, parts[0])
+		}
+		entries[parts[0]] = parts[1]
+	}
+	return entries, scanner.Err()
+}
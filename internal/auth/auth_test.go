@@ -0,0 +1,394 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// principalHandler responds with the name of the authenticated principal.
+var principalHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(auth.Principal(r.Context())))
+})
+
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "auth-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	return filename
+}
+
+func withCert(r *http.Request, subject pkix.Name) *http.Request {
+	r.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}},
+	}
+	return r
+}
+
+func newAuthenticators(t *testing.T) []auth.Authenticator {
+	tokens, err := auth.LoadTokens(writeFile(t, "# ci tokens\nci:secret-token\n\nrelease:other-token\n"))
+	if err != nil {
+		t.Fatalf("failed to load tokens: %s", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+	passwords, err := auth.LoadHtpasswd(writeFile(t, "alice:"+string(hash)+"\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	if err != nil {
+		t.Fatalf("failed to load htpasswd: %s", err)
+	}
+	certs := auth.NewClientCerts([]string{"builder", "CN=runner,O=Example"})
+	return []auth.Authenticator{tokens, passwords, certs}
+}
+
+func TestHandler(t *testing.T) {
+	handler := auth.Handler(principalHandler, newAuthenticators(t), nil, hatchet.Test(t))
+
+	tests := []struct {
+		name      string
+		request   func(*http.Request) *http.Request
+		code      int
+		principal string
+	}{
+		{
+			name:    "none",
+			request: func(r *http.Request) *http.Request { return r },
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name: "bearer",
+			request: func(r *http.Request) *http.Request {
+				r.Header.Set("Authorization", "Bearer secret-token")
+				return r
+			},
+			code:      http.StatusOK,
+			principal: "ci",
+		},
+		{
+			name: "bearer invalid",
+			request: func(r *http.Request) *http.Request {
+				r.Header.Set("Authorization", "Bearer wrong-token")
+				return r
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "basic bcrypt",
+			request: func(r *http.Request) *http.Request {
+				r.SetBasicAuth("alice", "password")
+				return r
+			},
+			code:      http.StatusOK,
+			principal: "alice",
+		},
+		{
+			name: "basic sha",
+			request: func(r *http.Request) *http.Request {
+				r.SetBasicAuth("bob", "password")
+				return r
+			},
+			code:      http.StatusOK,
+			principal: "bob",
+		},
+		{
+			name: "basic invalid",
+			request: func(r *http.Request) *http.Request {
+				r.SetBasicAuth("alice", "wrong")
+				return r
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "basic unknown user",
+			request: func(r *http.Request) *http.Request {
+				r.SetBasicAuth("mallory", "password")
+				return r
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "cert common name",
+			request: func(r *http.Request) *http.Request {
+				return withCert(r, pkix.Name{CommonName: "builder"})
+			},
+			code:      http.StatusOK,
+			principal: "builder",
+		},
+		{
+			name: "cert distinguished name",
+			request: func(r *http.Request) *http.Request {
+				return withCert(r, pkix.Name{CommonName: "runner", Organization: []string{"Example"}})
+			},
+			code:      http.StatusOK,
+			principal: "runner",
+		},
+		{
+			name: "cert forbidden",
+			request: func(r *http.Request) *http.Request {
+				return withCert(r, pkix.Name{CommonName: "runner"})
+			},
+			code: http.StatusForbidden,
+		},
+		{
+			name: "cert forbidden with invalid token",
+			request: func(r *http.Request) *http.Request {
+				r.Header.Set("Authorization", "Bearer wrong-token")
+				return withCert(r, pkix.Name{CommonName: "stranger"})
+			},
+			code: http.StatusForbidden,
+		},
+		{
+			name: "cert forbidden with valid token",
+			request: func(r *http.Request) *http.Request {
+				r.Header.Set("Authorization", "Bearer other-token")
+				return withCert(r, pkix.Name{CommonName: "stranger"})
+			},
+			code:      http.StatusOK,
+			principal: "release",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, test.request(httptest.NewRequest(http.MethodGet, "/cas/key", nil)))
+			if w.Code != test.code {
+				t.Fatalf("expected status code %d, got %d", test.code, w.Code)
+			}
+			if have := w.Body.String(); test.code == http.StatusOK && have != test.principal {
+				t.Errorf("expected principal %q, got %q", test.principal, have)
+			}
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	handler := auth.Handler(principalHandler, newAuthenticators(t), nil, hatchet.Test(t))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cas/key", nil))
+
+	want := []string{`Bearer realm="s3cache"`, `Basic realm="s3cache"`}
+	have := w.Result().Header["Www-Authenticate"]
+	if len(have) != len(want) {
+		t.Fatalf("expected challenges %q, got %q", want, have)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("expected challenge %q, got %q", want[i], have[i])
+		}
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	roles := auth.NewRoles(map[string]auth.Permission{"ci": auth.All}, auth.Read)
+	intercept := auth.UnaryServerInterceptor(newAuthenticators(t), roles, hatchet.Test(t))
+	info := &grpc.UnaryServerInfo{FullMethod: "/build.bazel.remote.execution.v2.ActionCache/GetActionResult"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return auth.Principal(ctx) + ":" + auth.Permissions(ctx).String(), nil
+	}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		code   codes.Code
+		result string
+	}{
+		{
+			name: "none",
+			ctx:  context.Background(),
+			code: codes.Unauthenticated,
+		},
+		{
+			name:   "bearer",
+			ctx:    metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret-token")),
+			code:   codes.OK,
+			result: "ci:all",
+		},
+		{
+			name: "invalid bearer",
+			ctx:  metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong-token")),
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "cert",
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{
+						VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "builder"}}}},
+					},
+				},
+			}),
+			code:   codes.OK,
+			result: "builder:read-ac,read-cas",
+		},
+		{
+			name: "forbidden cert",
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{
+						VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "intruder"}}}},
+					},
+				},
+			}),
+			code: codes.PermissionDenied,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := intercept(test.ctx, nil, info, handler)
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("expected status %s, got %s", test.code, code)
+			}
+			if test.code == codes.OK && result != test.result {
+				t.Errorf("expected result %q, got %q", test.result, result)
+			}
+		})
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	intercept := auth.StreamServerInterceptor(newAuthenticators(t), nil, hatchet.Test(t))
+	info := &grpc.StreamServerInfo{FullMethod: "/google.bytestream.ByteStream/Read"}
+	var principal string
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		principal = auth.Principal(stream.Context())
+		return nil
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer other-token"))
+	if err := intercept(nil, &serverStream{ctx: ctx}, info, handler); err != nil {
+		t.Fatalf("authentication failed: %s", err)
+	}
+	if principal != "release" {
+		t.Errorf("expected principal %q, got %q", "release", principal)
+	}
+
+	err := intercept(nil, &serverStream{ctx: context.Background()}, info, handler)
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("expected status %s, got %s", codes.Unauthenticated, code)
+	}
+}
+
+// serverStream is a stream which only carries a context.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestAnyCert(t *testing.T) {
+	certs := auth.NewClientCerts(nil)
+	r := withCert(httptest.NewRequest(http.MethodGet, "/cas/key", nil), pkix.Name{Organization: []string{"Example"}})
+	name, err := certs.Authenticate(r)
+	if err != nil {
+		t.Fatalf("authentication failed: %s", err)
+	}
+	if name != "O=Example" {
+		t.Errorf("expected principal %q, got %q", "O=Example", name)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	files := map[string]string{
+		"missing separator": "ci\n",
+		"empty token":       "ci:\n",
+		"duplicate name":    "ci:one\nci:two\n",
+	}
+	for name, content := range files {
+		if _, err := auth.LoadTokens(writeFile(t, content)); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+
+	if _, err := auth.LoadHtpasswd(writeFile(t, "alice:$apr1$salt$hash\n")); err == nil {
+		t.Error("expected an error for an unsupported hash")
+	}
+	if _, err := auth.LoadTokens("/nonexistent/tokens"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	tests := map[string]auth.Permission{
+		"none":                    auth.None,
+		"read":                    auth.ReadCAS | auth.ReadAC,
+		"read, write-cas":         auth.ReadCAS | auth.ReadAC | auth.WriteCAS,
+		"READ-AC":                 auth.ReadAC,
+		"all":                     auth.All,
+		"read,write-cas,write-ac": auth.All,
+	}
+	for value, want := range tests {
+		have, err := auth.ParsePermission(value)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", value, err)
+		} else if have != want {
+			t.Errorf("expected %s for %q, got %s", want, value, have)
+		}
+	}
+
+	if _, err := auth.ParsePermission("delete"); err == nil {
+		t.Error("expected an error for an unknown permission")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	roles, err := auth.LoadRoles(writeFile(t, "ci:all\nforks:read\n"), auth.ReadCAS)
+	if err != nil {
+		t.Fatalf("failed to load roles: %s", err)
+	}
+	handler := auth.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(auth.Permissions(r.Context()).String()))
+	}), newAuthenticators(t), roles, hatchet.Test(t))
+
+	tests := map[string]string{
+		"secret-token": "all",
+		"other-token":  "read-cas",
+	}
+	for token, want := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/cas/key", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(w, r)
+		if have := w.Body.String(); have != want {
+			t.Errorf("expected permissions %q for %s, got %q", want, token, have)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/cas/key", nil)
+	r.SetBasicAuth("alice", "password")
+	handler.ServeHTTP(w, r)
+	if have := w.Body.String(); have != "read-cas" {
+		t.Errorf("expected fallback permissions %q, got %q", "read-cas", have)
+	}
+
+	if _, err := auth.LoadRoles(writeFile(t, "ci:everything\n"), auth.None); err == nil {
+		t.Error("expected an error for an unknown permission")
+	}
+}
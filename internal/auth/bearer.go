@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+)
+
+// Tokens authenticates requests which carry a static bearer token in the
+// Authorization header. Bazel sends one when it is run with
+// --remote_header=Authorization="Bearer <token>".
+type Tokens struct {
+	// names are indexed by the hash of the token so that lookups do not leak
+	// the tokens through timing
+	names map[[sha256.Size]byte]string
+}
+
+// LoadTokens reads bearer tokens from a file. Each line of the file holds the
+// name of a principal and its token separated by a colon. Blank lines and
+// lines starting with # are ignored.
+func LoadTokens(filename string) (*Tokens, error) {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokens(entries), nil
+}
+
+// NewTokens returns an authenticator which accepts the given tokens. The map
+// is keyed by the name of the principal which owns each token.
+func NewTokens(tokens map[string]string) *Tokens {
+	t := &Tokens{
+		names: make(map[[sha256.Size]byte]string, len(tokens)),
+	}
+	for name, token := range tokens {
+		t.names[sha256.Sum256([]byte(token))] = name
+	}
+	return t
+}
+
+// Authenticate returns the name of the principal which owns the request's
+// bearer token.
+func (t *Tokens) Authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", ErrNoCredentials
+	}
+	token := strings.TrimSpace(header[7:])
+	name, ok := t.names[sha256.Sum256([]byte(token))]
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+	return name, nil
+}
+
+// Challenge returns the Bearer challenge.
+func (t *Tokens) Challenge() string {
+	return `Bearer realm="` + Realm + `"`
+}
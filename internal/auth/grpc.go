@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/zenreach/hatchet"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor returns a gRPC interceptor which authenticates unary
+// calls with the authenticators as Handler authenticates HTTP requests. Calls
+// without valid credentials are rejected with Unauthenticated and calls with
+// valid credentials which are not allowed access are rejected with
+// PermissionDenied. The principal and its permissions from roles are stored in
+// the call context.
+func UnaryServerInterceptor(authenticators []Authenticator, roles *Roles, logger hatchet.Logger) grpc.UnaryServerInterceptor {
+	a := &interceptor{
+		authenticators: authenticators,
+		roles:          roles,
+		logger:         logger,
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor which authenticates
+// streaming calls as UnaryServerInterceptor authenticates unary calls.
+func StreamServerInterceptor(authenticators []Authenticator, roles *Roles, logger hatchet.Logger) grpc.StreamServerInterceptor {
+	a := &interceptor{
+		authenticators: authenticators,
+		roles:          roles,
+		logger:         logger,
+	}
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(stream.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{
+			ServerStream: stream,
+			ctx:          ctx,
+		})
+	}
+}
+
+type interceptor struct {
+	authenticators []Authenticator
+	roles          *Roles
+	logger         hatchet.Logger
+}
+
+// authenticate the call and return a context which carries its principal.
+func (a *interceptor) authenticate(ctx context.Context, method string) (context.Context, error) {
+	r := callRequest(ctx, method)
+	id, err := authenticate(r, a.authenticators, a.roles)
+	if err == nil {
+		return context.WithValue(ctx, principalKey{}, id), nil
+	}
+	a.logDebug(err, r, "authentication failed")
+
+	if err == ErrForbidden {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil, status.Error(codes.Unauthenticated, err.Error())
+}
+
+func (a *interceptor) logDebug(err error, r *http.Request, msg string) {
+	a.logger.Log(hatchet.L{
+		"message": msg,
+		"level":   "debug",
+		"error":   err,
+		"remote":  r.RemoteAddr,
+		"method":  r.URL.Path,
+	})
+}
+
+// callRequest returns an HTTP request which carries the credentials of a gRPC
+// call so that it may be checked by the authenticators. Credentials are read
+// from the authorization metadata and the client certificate of the
+// connection.
+func callRequest(ctx context.Context, method string) *http.Request {
+	r := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: method},
+		Header: http.Header{},
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		r.Header.Add("Authorization", value)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			r.RemoteAddr = p.Addr.String()
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// serverStream replaces the context of a stream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
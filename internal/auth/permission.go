@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Permission is a set of operations a principal is allowed to perform.
+type Permission uint8
+
+const (
+	// ReadCAS allows reading from the CAS.
+	ReadCAS Permission = 1 << iota
+
+	// WriteCAS allows writing to the CAS.
+	WriteCAS
+
+	// ReadAC allows reading from the AC.
+	ReadAC
+
+	// WriteAC allows writing to the AC. Only trusted builds should be given
+	// this permission as action results are not verified.
+	WriteAC
+
+	// None allows nothing.
+	None Permission = 0
+
+	// Read allows reading from the CAS and AC.
+	Read = ReadCAS | ReadAC
+
+	// All allows every operation.
+	All = ReadCAS | WriteCAS | ReadAC | WriteAC
+)
+
+var permissionNames = map[string]Permission{
+	"none":      None,
+	"read-cas":  ReadCAS,
+	"write-cas": WriteCAS,
+	"read-ac":   ReadAC,
+	"write-ac":  WriteAC,
+	"read":      Read,
+	"all":       All,
+}
+
+// ParsePermission parses a comma separated list of permission names. Valid
+// names are read-cas, write-cas, read-ac, write-ac, read, all, and none.
+func ParsePermission(value string) (Permission, error) {
+	var p Permission
+	for _, name := range strings.Split(value, ",") {
+		q, ok := permissionNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return None, fmt.Errorf("unknown permission %q", name)
+		}
+		p |= q
+	}
+	return p, nil
+}
+
+// Has returns true if p includes every permission in q.
+func (p Permission) Has(q Permission) bool {
+	return p&q == q
+}
+
+func (p Permission) String() string {
+	switch p {
+	case None:
+		return "none"
+	case All:
+		return "all"
+	}
+	var names []string
+	for name, q := range permissionNames {
+		if q != None && q != Read && q != All && p.Has(q) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Roles assigns permissions to principals.
+type Roles struct {
+	permissions map[string]Permission
+	fallback    Permission
+}
+
+// LoadRoles reads the permissions of each principal from a file. Each line of
+// the file holds the name of a principal and its permissions separated by a
+// colon, such as "pull-requests:read,write-cas". Principals which are not
+// listed are given the fallback permissions.
+func LoadRoles(filename string, fallback Permission) (*Roles, error) {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return nil, err
+	}
+	permissions := make(map[string]Permission, len(entries))
+	for name, value := range entries {
+		p, err := ParsePermission(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: principal %q: %s", filename, name, err)
+		}
+		permissions[name] = p
+	}
+	return NewRoles(permissions, fallback), nil
+}
+
+// NewRoles returns roles which assign the given permissions to each
+// principal. Principals which are not listed are given the fallback
+// permissions.
+func NewRoles(permissions map[string]Permission, fallback Permission) *Roles {
+	return &Roles{
+		permissions: permissions,
+		fallback:    fallback,
+	}
+}
+
+// Permissions returns the permissions of the named principal.
+func (r *Roles) Permissions(name string) Permission {
+	if r == nil {
+		return All
+	}
+	if p, ok := r.permissions[name]; ok {
+		return p
+	}
+	return r.fallback
+}
+
+// Permissions returns the permissions of the principal stored in the context
+// by Handler or the gRPC interceptors. Every permission is granted if the
+// request was not authenticated as authentication is disabled.
+func Permissions(ctx context.Context) Permission {
+	id, ok := ctx.Value(principalKey{}).(identity)
+	if !ok {
+		return All
+	}
+	return id.permissions
+}
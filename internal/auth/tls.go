@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+)
+
+// ClientCerts authenticates requests made over a TLS connection with a
+// verified client certificate. The server must be configured to request and
+// verify client certificates. Bazel presents one when it is run with
+// --tls_client_certificate and --tls_client_key.
+type ClientCerts struct {
+	subjects map[string]bool
+}
+
+// NewClientCerts returns an authenticator which accepts verified client
+// certificates whose subject common name or distinguished name is one of the
+// given subjects. Distinguished names are in RFC 2253 form, such as
+// "CN=ci,O=Example". Any verified certificate is accepted if subjects is
+// empty.
+func NewClientCerts(subjects []string) *ClientCerts {
+	c := &ClientCerts{
+		subjects: make(map[string]bool, len(subjects)),
+	}
+	for _, subject := range subjects {
+		c.subjects[subject] = true
+	}
+	return c
+}
+
+// Authenticate returns the subject of the request's client certificate.
+// ErrForbidden is returned if the subject is not allowed.
+func (c *ClientCerts) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(c.subjects) > 0 && !c.subjects[cert.Subject.CommonName] && !c.subjects[cert.Subject.String()] {
+		return "", ErrForbidden
+	}
+	return subjectName(cert), nil
+}
+
+// Challenge returns an empty string. Client certificates are requested during
+// the TLS handshake.
+func (c *ClientCerts) Challenge() string {
+	return ""
+}
+
+// subjectName returns the common name of the certificate or its full
+// distinguished name if it has none.
+func subjectName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
@@ -4,12 +4,48 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
+	"time"
 )
 
 var (
 	ErrCacheMiss = errors.New("cache miss")
+
+	// ErrUnavailable is returned instead of ErrCacheMiss by a cache which
+	// could not check for the object, such as while it fails fast during an
+	// outage. It is treated as a miss which must not be remembered.
+	ErrUnavailable = errors.New("cache unavailable")
 )
 
+// IsMiss returns true if the error is ErrCacheMiss or ErrUnavailable.
+func IsMiss(err error) bool {
+	return err == ErrCacheMiss || err == ErrUnavailable
+}
+
+// Metadata describes how a cached object is stored. It is provided when the
+// object is put and returned when the object is stat'd or read.
+type Metadata struct {
+	// ContentEncoding is the encoding applied to the stored bytes, such as
+	// "gzip" or "identity". An empty value means the encoding was not
+	// recorded.
+	ContentEncoding string
+
+	// ContentLength is the length of the object after it is decoded. It is -1
+	// if the length is unknown.
+	ContentLength int64
+}
+
+// Info describes a cached object.
+type Info struct {
+	Metadata
+
+	// Size is the number of bytes stored in the cache.
+	Size int64
+
+	// LastModified is the time the object was last written.
+	LastModified time.Time
+}
+
 type Cache interface {
 	// Get returns a reader providing access to the named cache object. An
 	// ErrCacheMiss is returned if the object does not exist. Other
@@ -18,8 +54,100 @@ type Cache interface {
 	// operation then the operation is cancelled and ctx.Err() is returned.
 	Get(context.Context, string) (io.ReadCloser, error)
 
-	// Put caches the contents of a reader with the given name. An error is
-	// returned on failure. If the context expires during the get operation
-	// then the operation is cancelled and ctx.Err() is returned.
-	Put(context.Context, string, io.Reader) error
+	// Stat returns information about the named cache object without reading
+	// it. An ErrCacheMiss is returned if the object does not exist. If the
+	// context expires during the operation then it is cancelled and
+	// ctx.Err() is returned.
+	Stat(context.Context, string) (*Info, error)
+
+	// Put caches the contents of a reader with the given name. The metadata
+	// is stored alongside the object. An error is returned on failure. If the
+	// context expires during the get operation then the operation is
+	// cancelled and ctx.Err() is returned.
+	Put(context.Context, string, io.Reader, Metadata) error
+}
+
+// RangeGetter is implemented by caches which read part of an object without
+// reading the data before it.
+type RangeGetter interface {
+	// GetRange returns a reader of up to length bytes of the stored object
+	// starting at offset. A negative length reads to the end of the object.
+	// The reader is empty if offset is past the end of the object. Errors
+	// are returned as by Get.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// GetRange returns a reader of part of the named cache object as described by
+// RangeGetter. The data before the offset is read and discarded if the cache
+// is not a RangeGetter.
+func GetRange(ctx context.Context, c Cache, key string, offset, length int64) (io.ReadCloser, error) {
+	if rg, ok := c.(RangeGetter); ok {
+		return rg.GetRange(ctx, key, offset, length)
+	}
+	rdr, err := c.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(ioutil.Discard, rdr, offset)
+	if err != nil && err != io.EOF {
+		rdr.Close()
+		return nil, err
+	}
+	return LimitReadCloser(rdr, length), nil
+}
+
+// LimitReadCloser returns a reader of up to length bytes of rdr. A negative
+// length reads all of rdr. Closing the returned reader closes rdr.
+func LimitReadCloser(rdr io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return rdr
+	}
+	return &limitReadCloser{
+		Reader: io.LimitReader(rdr, length),
+		src:    rdr,
+	}
+}
+
+type limitReadCloser struct {
+	io.Reader
+	src io.ReadCloser
+}
+
+func (r *limitReadCloser) Close() error {
+	return r.src.Close()
+}
+
+// Describer is implemented by readers returned by Get which know the metadata
+// of the object they read.
+type Describer interface {
+	// Metadata returns the metadata of the object being read.
+	Metadata() Metadata
+}
+
+// ReaderMetadata returns the metadata of the object read by a reader returned
+// by Get. False is returned if the reader does not describe its object.
+func ReaderMetadata(rdr io.Reader) (Metadata, bool) {
+	d, ok := rdr.(Describer)
+	if !ok {
+		return Metadata{}, false
+	}
+	return d.Metadata(), true
+}
+
+// Bounded is implemented by caches which do not keep objects larger than a
+// maximum size.
+type Bounded interface {
+	// MaxObjectSize returns the size of the largest object kept by the cache.
+	MaxObjectSize() int64
+}
+
+// Contains returns true if the named object exists in the cache.
+func Contains(ctx context.Context, c Cache, key string) (bool, error) {
+	_, err := c.Stat(ctx, key)
+	if IsMiss(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
 }
@@ -3,29 +3,38 @@ package cachetest
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/zenreach/hydroponics/internal/cache"
 )
 
-// Test a cache implementation.
-func Test(t *testing.T, factory func() cache.Cache) {
+// Test a cache implementation. The factory is called with each subtest so
+// that it may fail the subtest and register cleanups with it.
+func Test(t *testing.T, factory func(*testing.T) cache.Cache) {
 	t.Parallel()
 	tests := map[string]func(*testing.T, cache.Cache){
 		"get hit":      testGetHit,
 		"get miss":     testGetMiss,
+		"get metadata": testGetMetadata,
+		"get range":    testGetRange,
+		"range miss":   testGetRangeMiss,
 		"put existing": testPutExisting,
+		"stat hit":     testStatHit,
+		"stat miss":    testStatMiss,
+		"concurrent":   testConcurrent,
 	}
 
 	for name := range tests {
 		test := tests[name]
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
-			test(t, factory())
+			test(t, factory(t))
 		})
 	}
 }
@@ -41,6 +50,71 @@ func testGetMiss(t *testing.T, c cache.Cache) {
 	AssertMiss(t, c, "missing")
 }
 
+func testGetMetadata(t *testing.T, c cache.Cache) {
+	key := "metadata"
+	data := []byte("example cache value")
+	meta := cache.Metadata{
+		ContentEncoding: "identity",
+		ContentLength:   int64(len(data)),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	err := c.Put(ctx, key, NewReader(data), meta)
+	if err != nil {
+		t.Fatalf("failed to put value: %s", err)
+	}
+	rdr, err := c.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get value: %s", err)
+	}
+	defer rdr.Close()
+	have, ok := cache.ReaderMetadata(rdr)
+	if !ok {
+		t.Fatal("expected reader to describe the object")
+	}
+	if have != meta {
+		t.Errorf("expected metadata %+v, got %+v", meta, have)
+	}
+}
+
+func testGetRange(t *testing.T, c cache.Cache) {
+	key := "range"
+	data := []byte("example cache value")
+	AssertPut(t, c, key, data)
+
+	tests := []struct {
+		offset int64
+		length int64
+		want   string
+	}{
+		{0, -1, "example cache value"},
+		{0, 7, "example"},
+		{8, 5, "cache"},
+		{14, -1, "value"},
+		{14, 100, "value"},
+		{19, -1, ""},
+		{100, 5, ""},
+	}
+	for _, test := range tests {
+		AssertGetRange(t, c, key, test.offset, test.length, []byte(test.want))
+	}
+}
+
+func testGetRangeMiss(t *testing.T, c cache.Cache) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	rdr, err := cache.GetRange(ctx, c, "missing", 0, 1)
+	if err != cache.ErrCacheMiss {
+		t.Errorf("expected \"%s\", got \"%s\"", cache.ErrCacheMiss, err)
+	}
+	if rdr != nil {
+		t.Error("expected nil reader")
+	}
+}
+
 func testPutExisting(t *testing.T, c cache.Cache) {
 	key := "exists"
 	data1 := []byte("replace this value")
@@ -51,13 +125,126 @@ func testPutExisting(t *testing.T, c cache.Cache) {
 	AssertGet(t, c, key, data2)
 }
 
+func testStatHit(t *testing.T, c cache.Cache) {
+	key := "stat"
+	data := []byte("example cache value")
+	meta := cache.Metadata{
+		ContentEncoding: "identity",
+		ContentLength:   int64(len(data)),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	start := time.Now().Add(-time.Second)
+	err := c.Put(ctx, key, NewReader(data), meta)
+	if err != nil {
+		t.Fatalf("failed to put value: %s", err)
+	}
+
+	info := AssertStat(t, c, key)
+	if info.Size != int64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), info.Size)
+	}
+	if info.Metadata != meta {
+		t.Errorf("expected metadata %+v, got %+v", meta, info.Metadata)
+	}
+	if info.LastModified.Before(start) {
+		t.Errorf("expected last modified after %s, got %s", start, info.LastModified)
+	}
+	AssertContains(t, c, key, true)
+}
+
+func testStatMiss(t *testing.T, c cache.Cache) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	info, err := c.Stat(ctx, "missing")
+	if err != cache.ErrCacheMiss {
+		t.Errorf("expected \"%s\", got \"%s\"", cache.ErrCacheMiss, err)
+	}
+	if info != nil {
+		t.Error("expected nil info")
+	}
+	AssertContains(t, c, "missing", false)
+}
+
+func testConcurrent(t *testing.T, c cache.Cache) {
+	const (
+		workers = 16
+		keys    = 8
+		ops     = 50
+	)
+
+	// each key always holds the same value so that any successful read can
+	// be checked regardless of the order of the writes
+	value := func(key string) []byte {
+		return bytes.Repeat([]byte(key), 64)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("concurrent-%d", (w+i)%keys)
+				if err := concurrentOp(c, key, value(key), i%2 == 0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// concurrentOp puts or gets a key. A miss is allowed as the cache may evict
+// objects at any time.
+func concurrentOp(c cache.Cache, key string, want []byte, put bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if put {
+		err := c.Put(ctx, key, NewReader(want), cache.Metadata{
+			ContentLength: int64(len(want)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to put %s: %s", key, err)
+		}
+		return nil
+	}
+
+	rdr, err := c.Get(ctx, key)
+	if err == cache.ErrCacheMiss {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get %s: %s", key, err)
+	}
+	defer rdr.Close()
+	have, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", key, err)
+	}
+	if !bytes.Equal(have, want) {
+		return fmt.Errorf("expected value \"%s\" for %s, got \"%s\"", want, key, have)
+	}
+	return nil
+}
+
 func AssertGet(t *testing.T, c cache.Cache, key string, want []byte) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
 	rdr, err := c.Get(ctx, key)
 	if err != nil {
-		t.Fatalf("failed to get value: %s")
+		t.Fatalf("failed to get value: %s", err)
 	}
 	have := ReadAll(t, rdr)
 	if !reflect.DeepEqual(have, want) {
@@ -65,13 +252,53 @@ func AssertGet(t *testing.T, c cache.Cache, key string, want []byte) {
 	}
 }
 
+func AssertGetRange(t *testing.T, c cache.Cache, key string, offset, length int64, want []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	rdr, err := cache.GetRange(ctx, c, key, offset, length)
+	if err != nil {
+		t.Fatalf("failed to get range %d+%d: %s", offset, length, err)
+	}
+	have := ReadAll(t, rdr)
+	if !bytes.Equal(have, want) {
+		t.Errorf("expected range %d+%d to be \"%s\", got \"%s\"", offset, length, want, have)
+	}
+}
+
 func AssertPut(t *testing.T, c cache.Cache, key string, have []byte) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
-	err := c.Put(ctx, key, NewReader(have))
+	err := c.Put(ctx, key, NewReader(have), cache.Metadata{
+		ContentLength: int64(len(have)),
+	})
 	if err != nil {
-		t.Fatalf("failed to put value: %s")
+		t.Fatalf("failed to put value: %s", err)
+	}
+}
+
+func AssertStat(t *testing.T, c cache.Cache, key string) *cache.Info {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	info, err := c.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to stat value: %s", err)
+	}
+	return info
+}
+
+func AssertContains(t *testing.T, c cache.Cache, key string, want bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	have, err := cache.Contains(ctx, c, key)
+	if err != nil {
+		t.Fatalf("failed to check for value: %s", err)
+	}
+	if have != want {
+		t.Errorf("expected contains %t, got %t", want, have)
 	}
 }
 
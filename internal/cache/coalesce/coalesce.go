@@ -0,0 +1,184 @@
+package coalesce
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/tracing"
+)
+
+// DefaultBufferSize is the default number of bytes of a shared read held in
+// memory for the readers which fall behind.
+const DefaultBufferSize = 8 * 1024 * 1024
+
+// Config configures a coalescing cache.
+type Config struct {
+	// BufferSize is the maximum number of bytes of a shared read held in
+	// memory. The read from the wrapped cache pauses while the slowest
+	// reader is this far behind. Defaults to DefaultBufferSize.
+	BufferSize int
+
+	// Timeout is the maximum duration of a shared read. The read is not bound
+	// to the request which started it so that it may outlive that request
+	// for the others. A zero value disables the timeout.
+	Timeout time.Duration
+
+	// ContentAddressed coalesces concurrent puts of the same key. It must
+	// only be set for caches whose keys identify their contents, such as the
+	// CAS, as only the first of the puts is stored.
+	ContentAddressed bool
+}
+
+// Cache wraps a cache so that concurrent requests for the same key share a
+// single request to the wrapped cache. A Get which arrives while another Get
+// of the key is reading the object joins it and receives the same data. The
+// object is read once and streamed to every reader. Puts of content addressed
+// objects which arrive while the key is being put wait for the first put and
+// discard their data if it succeeds.
+type Cache struct {
+	cache            cache.Cache
+	bufferSize       int
+	timeout          time.Duration
+	contentAddressed bool
+
+	mu      sync.Mutex
+	fetches map[string]*fetch
+	uploads map[string]*upload
+}
+
+// New returns a cache which coalesces concurrent requests to c.
+func New(c cache.Cache, cfg Config) *Cache {
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	return &Cache{
+		cache:            c,
+		bufferSize:       bufferSize,
+		timeout:          cfg.Timeout,
+		contentAddressed: cfg.ContentAddressed,
+		fetches:          make(map[string]*fetch),
+		uploads:          make(map[string]*upload),
+	}
+}
+
+func (c *Cache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	f := c.fetches[key]
+	rdr := f.join(ctx)
+	if rdr == nil {
+		f = c.startFetch(ctx, key)
+		rdr = f.join(ctx)
+	} else {
+		coalescedTotal.WithLabelValues(opGet).Inc()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		rdr.Close()
+		return nil, ctx.Err()
+	}
+	if f.getErr != nil {
+		rdr.Close()
+		return nil, f.getErr
+	}
+	if f.described {
+		return &describedReader{reader: rdr, meta: f.meta}, nil
+	}
+	return rdr, nil
+}
+
+// GetRange is not coalesced as concurrent reads rarely request the same
+// range.
+func (c *Cache) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return cache.GetRange(ctx, c.cache, key, offset, length)
+}
+
+func (c *Cache) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	return c.cache.Stat(ctx, key)
+}
+
+// Put stores the object in the wrapped cache. If the cache is content
+// addressed and the key is already being put then Put waits for that put to
+// finish. The data is discarded if it succeeded and stored otherwise. The
+// discarded data is still read so that the writer finishes and verifies it.
+func (c *Cache) Put(ctx context.Context, key string, data io.Reader, meta cache.Metadata) error {
+	if !c.contentAddressed {
+		return c.cache.Put(ctx, key, data, meta)
+	}
+	for {
+		c.mu.Lock()
+		u, ok := c.uploads[key]
+		if !ok {
+			u = &upload{done: make(chan struct{})}
+			c.uploads[key] = u
+			c.mu.Unlock()
+
+			u.err = c.cache.Put(ctx, key, data, meta)
+			c.mu.Lock()
+			delete(c.uploads, key)
+			c.mu.Unlock()
+			close(u.done)
+			return u.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-u.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if u.err == nil {
+			coalescedTotal.WithLabelValues(opPut).Inc()
+			_, err := io.Copy(ioutil.Discard, data)
+			return err
+		}
+	}
+}
+
+// upload is a put in progress.
+type upload struct {
+	done chan struct{} // closed once the put finishes
+	err  error
+}
+
+// startFetch starts reading the object from the wrapped cache. The fetch is
+// traced as part of the request which started it but is only cancelled once
+// all of its readers are closed or the timeout expires. The caller must hold
+// c.mu.
+func (c *Cache) startFetch(ctx context.Context, key string) *fetch {
+	ctx = tracing.Detach(ctx)
+	var cancel context.CancelFunc
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	f := &fetch{
+		c:        c,
+		key:      key,
+		cancel:   cancel,
+		ready:    make(chan struct{}),
+		changed:  make(chan struct{}),
+		readers:  make(map[*reader]bool),
+		joinable: true,
+	}
+	c.fetches[key] = f
+	go f.run(ctx)
+	return f
+}
+
+// forget removes the fetch once it is finished.
+func (c *Cache) forget(f *fetch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fetches[f.key] == f {
+		delete(c.fetches, f.key)
+	}
+}
@@ -0,0 +1,305 @@
+package coalesce_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/coalesce"
+	"github.com/zenreach/hydroponics/internal/cache/memory"
+)
+
+// coalesceWait is how long the tests wait for concurrent requests to arrive
+// before the backend responds.
+const coalesceWait = 100 * time.Millisecond
+
+// gatedCache counts the requests to a memory cache. Gets and puts wait until
+// the gate is opened.
+type gatedCache struct {
+	cache.Cache
+	gate    chan struct{}
+	gets    int32
+	puts    int32
+	failPut bool // fail the first put
+	closed  int32
+}
+
+func newGatedCache() *gatedCache {
+	return &gatedCache{
+		Cache: memory.New(4*1024*1024, 4*1024*1024),
+		gate:  make(chan struct{}),
+	}
+}
+
+func (c *gatedCache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	atomic.AddInt32(&c.gets, 1)
+	<-c.gate
+	rdr, err := c.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &closeCounter{ReadCloser: rdr, closed: &c.closed}, nil
+}
+
+func (c *gatedCache) Put(ctx context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
+	n := atomic.AddInt32(&c.puts, 1)
+	<-c.gate
+	if c.failPut && n == 1 {
+		return errors.New("put failed")
+	}
+	return c.Cache.Put(ctx, key, rdr, meta)
+}
+
+type closeCounter struct {
+	io.ReadCloser
+	closed *int32
+}
+
+func (c *closeCounter) Metadata() cache.Metadata {
+	meta, _ := cache.ReaderMetadata(c.ReadCloser)
+	return meta
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return c.ReadCloser.Close()
+}
+
+func TestCommon(t *testing.T) {
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		backend := newGatedCache()
+		close(backend.gate)
+		return coalesce.New(backend, coalesce.Config{ContentAddressed: true})
+	})
+}
+
+func TestGet(t *testing.T) {
+	backend := newGatedCache()
+	c := coalesce.New(backend, coalesce.Config{BufferSize: 1024})
+	value := bytes.Repeat([]byte("value"), 64*1024)
+	if err := backend.Cache.Put(context.Background(), "key", bytes.NewReader(value), cache.Metadata{ContentLength: -1}); err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+
+	const readers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rdr, err := c.Get(context.Background(), "key")
+			if err != nil {
+				t.Errorf("failed to get: %s", err)
+				return
+			}
+			// readers consume the object at different rates
+			time.Sleep(time.Duration(i) * time.Millisecond)
+			if have := cachetest.ReadAll(t, rdr); !bytes.Equal(have, value) {
+				t.Errorf("reader %d read %d bytes, expected %d", i, len(have), len(value))
+			}
+		}(i)
+	}
+	time.Sleep(coalesceWait)
+	close(backend.gate)
+	wg.Wait()
+
+	if gets := atomic.LoadInt32(&backend.gets); gets != 1 {
+		t.Errorf("expected 1 backend get, got %d", gets)
+	}
+	if closed := atomic.LoadInt32(&backend.closed); closed != 1 {
+		t.Errorf("expected backend reader to be closed once, got %d", closed)
+	}
+
+	// a get after the shared read finishes reads the object again
+	cachetest.AssertGet(t, c, "key", value)
+	if gets := atomic.LoadInt32(&backend.gets); gets != 2 {
+		t.Errorf("expected 2 backend gets, got %d", gets)
+	}
+}
+
+func TestGetMiss(t *testing.T) {
+	backend := newGatedCache()
+	c := coalesce.New(backend, coalesce.Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(context.Background(), "missing"); err != cache.ErrCacheMiss {
+				t.Errorf("expected cache miss, got %v", err)
+			}
+		}()
+	}
+	time.Sleep(coalesceWait)
+	close(backend.gate)
+	wg.Wait()
+
+	if gets := atomic.LoadInt32(&backend.gets); gets != 1 {
+		t.Errorf("expected 1 backend get, got %d", gets)
+	}
+}
+
+func TestGetClose(t *testing.T) {
+	backend := newGatedCache()
+	close(backend.gate)
+	c := coalesce.New(backend, coalesce.Config{BufferSize: 1024})
+	value := bytes.Repeat([]byte("value"), 64*1024)
+	cachetest.AssertPut(t, c, "key", value)
+
+	// the shared read stops once every reader is closed
+	first, err := c.Get(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("failed to get: %s", err)
+	}
+	second, err := c.Get(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("failed to get: %s", err)
+	}
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	first.Close()
+	second.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&backend.closed) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("backend reader was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetCancel(t *testing.T) {
+	backend := newGatedCache()
+	defer close(backend.gate)
+	c := coalesce.New(backend, coalesce.Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "key"); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+// stalledCache never responds to a get before its context is done.
+type stalledCache struct {
+	cache.Cache
+}
+
+func (c *stalledCache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGetTimeout(t *testing.T) {
+	c := coalesce.New(&stalledCache{Cache: memory.New(1024, 1024)}, coalesce.Config{
+		Timeout: 50 * time.Millisecond,
+	})
+
+	// the shared read is bound by the timeout rather than the request
+	errs := make(chan error)
+	go func() {
+		_, err := c.Get(context.Background(), "key")
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("get did not time out")
+	}
+}
+
+func TestPut(t *testing.T) {
+	backend := newGatedCache()
+	c := coalesce.New(backend, coalesce.Config{ContentAddressed: true})
+	value := []byte("value")
+
+	const puts = 8
+	var wg sync.WaitGroup
+	for i := 0; i < puts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := bytes.NewReader(value)
+			if err := c.Put(context.Background(), "key", data, cache.Metadata{ContentLength: -1}); err != nil {
+				t.Errorf("failed to put: %s", err)
+			}
+			if data.Len() != 0 {
+				t.Errorf("expected put to read its data, %d bytes left", data.Len())
+			}
+		}()
+	}
+	time.Sleep(coalesceWait)
+	close(backend.gate)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&backend.puts); n != 1 {
+		t.Errorf("expected 1 backend put, got %d", n)
+	}
+	cachetest.AssertGet(t, backend.Cache, "key", value)
+}
+
+func TestPutFailed(t *testing.T) {
+	backend := newGatedCache()
+	backend.failPut = true
+	c := coalesce.New(backend, coalesce.Config{ContentAddressed: true})
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- c.Put(context.Background(), "key", bytes.NewReader([]byte("value")), cache.Metadata{ContentLength: -1})
+		}()
+		// the first put must start before the second
+		time.Sleep(coalesceWait)
+	}
+	close(backend.gate)
+
+	// the waiting put stores the object when the first put fails
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected 1 failed put, got %d", failed)
+	}
+	cachetest.AssertGet(t, backend.Cache, "key", []byte("value"))
+}
+
+func TestPutNotContentAddressed(t *testing.T) {
+	backend := newGatedCache()
+	c := coalesce.New(backend, coalesce.Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.Put(context.Background(), "key", bytes.NewReader([]byte("value")), cache.Metadata{ContentLength: -1})
+			if err != nil {
+				t.Errorf("failed to put: %s", err)
+			}
+		}()
+	}
+	time.Sleep(coalesceWait)
+	close(backend.gate)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&backend.puts); n != 4 {
+		t.Errorf("expected 4 backend puts, got %d", n)
+	}
+}
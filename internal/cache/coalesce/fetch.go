@@ -0,0 +1,271 @@
+package coalesce
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+)
+
+// chunkSize is the number of bytes read from the wrapped cache at once.
+const chunkSize = 32 * 1024
+
+// chunk is part of a shared object which starts at offset.
+type chunk struct {
+	offset int64
+	data   []byte
+}
+
+// fetch reads an object from the wrapped cache and streams it to each of its
+// readers. Chunks read by every reader are discarded when the buffer fills.
+// Readers may join until the first chunk is discarded.
+type fetch struct {
+	c      *Cache
+	key    string
+	cancel context.CancelFunc
+
+	// ready is closed once the wrapped Get returns. getErr holds its error.
+	// meta holds the object's metadata if the wrapped reader described it.
+	ready     chan struct{}
+	getErr    error
+	meta      cache.Metadata
+	described bool
+
+	mu       sync.Mutex
+	changed  chan struct{} // closed when data is read or a reader leaves
+	chunks   []chunk
+	end      int64 // offset following the last chunk
+	done     bool  // the object was read or the fetch failed
+	err      error // error which ended the fetch
+	readers  map[*reader]bool
+	joinable bool
+}
+
+// join adds a reader to the fetch. Nil is returned if f is nil or may no
+// longer be joined. A fetch which may not be joined is replaced by a new one.
+func (f *fetch) join(ctx context.Context) *reader {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.joinable {
+		return nil
+	}
+	r := &reader{f: f, ctx: ctx}
+	f.readers[r] = true
+	return r
+}
+
+func (f *fetch) run(ctx context.Context) {
+	defer f.cancel()
+	defer f.c.forget(f)
+
+	rdr, err := f.c.cache.Get(ctx, f.key)
+	f.getErr = err
+	if err == nil {
+		f.meta, f.described = cache.ReaderMetadata(rdr)
+	}
+	close(f.ready)
+	if err != nil {
+		f.finish(err)
+		return
+	}
+	defer rdr.Close()
+
+	for {
+		buf := make([]byte, chunkSize)
+		n, err := readChunk(rdr, buf)
+		if n > 0 && !f.append(ctx, buf[:n]) {
+			f.finish(ctx.Err())
+			return
+		}
+		if err == io.EOF {
+			f.finish(nil)
+			return
+		} else if err != nil {
+			f.finish(err)
+			return
+		}
+	}
+}
+
+// readChunk fills buf from rdr. It returns early only if rdr returns an
+// error, which is io.EOF at the end of the object.
+func readChunk(rdr io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := rdr.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// append adds a chunk for the readers. Chunks are kept until the buffer is
+// full so that readers may join small objects at any time. It then waits
+// while the unread data fills the buffer. False is returned if the fetch was
+// cancelled.
+func (f *fetch) append(ctx context.Context, data []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.buffered() >= int64(f.c.bufferSize) {
+		f.discard()
+		if f.buffered() < int64(f.c.bufferSize) {
+			break
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			f.mu.Lock()
+			return false
+		}
+		f.mu.Lock()
+	}
+	f.chunks = append(f.chunks, chunk{offset: f.end, data: data})
+	f.end += int64(len(data))
+	f.notify()
+	return true
+}
+
+// discard drops the chunks read by every reader. The fetch may no longer be
+// joined once a chunk is dropped. The caller must hold f.mu.
+func (f *fetch) discard() {
+	read := f.end
+	for r := range f.readers {
+		if r.offset < read {
+			read = r.offset
+		}
+	}
+	i := 0
+	for i < len(f.chunks) && f.chunks[i].offset+int64(len(f.chunks[i].data)) <= read {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	f.chunks = f.chunks[i:]
+	f.joinable = false
+}
+
+// buffered returns the number of bytes held by the fetch. The caller must
+// hold f.mu.
+func (f *fetch) buffered() int64 {
+	if len(f.chunks) == 0 {
+		return 0
+	}
+	return f.end - f.chunks[0].offset
+}
+
+// finish ends the fetch with the given error. Nil means the object was read
+// completely.
+func (f *fetch) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done = true
+	f.err = err
+	f.joinable = false
+	f.notify()
+}
+
+// notify wakes the readers and the fetch waiting on a change. The caller must
+// hold f.mu.
+func (f *fetch) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// reader reads a shared object.
+type reader struct {
+	f      *fetch
+	ctx    context.Context
+	offset int64
+	closed bool
+}
+
+// Read waits until data is available or the reader's context expires.
+func (r *reader) Read(buf []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		if r.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if r.offset < f.end {
+			n := f.copyAt(buf, r.offset)
+			r.offset += int64(n)
+			f.notify()
+			return n, nil
+		}
+		if f.done {
+			if f.err != nil {
+				return 0, f.err
+			}
+			return 0, io.EOF
+		}
+
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			f.mu.Lock()
+			return 0, r.ctx.Err()
+		}
+		f.mu.Lock()
+	}
+}
+
+// copyAt copies buffered data starting at offset into buf. The caller must
+// hold f.mu.
+func (f *fetch) copyAt(buf []byte, offset int64) int {
+	n := 0
+	for _, c := range f.chunks {
+		end := c.offset + int64(len(c.data))
+		if end <= offset {
+			continue
+		}
+		m := copy(buf[n:], c.data[offset-c.offset:])
+		n += m
+		offset += int64(m)
+		if n == len(buf) {
+			break
+		}
+	}
+	return n
+}
+
+// Close removes the reader from the fetch. The fetch is cancelled once all of
+// its readers are closed.
+func (r *reader) Close() error {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	delete(f.readers, r)
+	if len(f.readers) == 0 && !f.done {
+		f.joinable = false
+		f.cancel()
+	}
+	f.notify()
+	return nil
+}
+
+// describedReader is a reader of a shared object whose metadata is known.
+type describedReader struct {
+	*reader
+	meta cache.Metadata
+}
+
+func (r *describedReader) Metadata() cache.Metadata {
+	return r.meta
+}
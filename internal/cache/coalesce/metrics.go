@@ -0,0 +1,19 @@
+package coalesce
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Operations recorded in metrics.
+const (
+	opGet = "get"
+	opPut = "put"
+)
+
+var coalescedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "hydroponics",
+	Subsystem: "coalesce",
+	Name:      "requests_total",
+	Help:      "Requests served by another request for the same key by operation.",
+}, []string{"operation"})
@@ -0,0 +1,389 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/tracing"
+)
+
+// Content encodings of stored objects.
+const (
+	// Identity objects are stored as-is.
+	Identity = "identity"
+
+	// Gzip objects are gzip compressed. Objects without a recorded encoding
+	// were stored before encodings were recorded and are also gzip
+	// compressed.
+	Gzip = "gzip"
+
+	// Zstd objects are zstd compressed.
+	Zstd = "zstd"
+)
+
+// ErrInvalid is returned by PutEncoded if the data is not validly encoded or
+// fails its check.
+var ErrInvalid = errors.New("invalid encoded data")
+
+const (
+	// sampleSize is the number of bytes at the start of an object which are
+	// compressed to decide whether the object is worth compressing.
+	sampleSize = 64 * 1024
+
+	// minSavings is the fraction of the sample which must be saved by
+	// compression for the object to be compressed.
+	minSavings = 0.1
+)
+
+// Config configures a codec.
+type Config struct {
+	// Encoding is the content encoding of stored objects: Identity, Gzip, or
+	// Zstd. Defaults to Gzip.
+	Encoding string
+
+	// Level is the compression level. Gzip levels are 1 to 9 and zstd levels
+	// are 1 to 22. Defaults to the default level of the encoding.
+	Level int
+}
+
+// Codec compresses objects as they are put into a cache. The encoding is
+// recorded in the object's metadata so that Get decodes objects stored by any
+// codec. A nil Codec uses the default encoding and level.
+type Codec struct {
+	encoding string
+	level    int
+}
+
+// New returns a codec which stores objects with the configured encoding.
+func New(cfg Config) (*Codec, error) {
+	c := &Codec{
+		encoding: cfg.Encoding,
+		level:    cfg.Level,
+	}
+	if c.encoding == "" {
+		c.encoding = Gzip
+	}
+
+	var minLevel, maxLevel int
+	switch c.encoding {
+	case Identity:
+	case Gzip:
+		minLevel, maxLevel = gzip.BestSpeed, gzip.BestCompression
+	case Zstd:
+		minLevel, maxLevel = 1, 22
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", c.encoding)
+	}
+	if c.level != 0 && (c.level < minLevel || c.level > maxLevel) {
+		return nil, fmt.Errorf("invalid %s compression level %d", c.encoding, c.level)
+	}
+	return c, nil
+}
+
+// Encoding returns the content encoding of the objects stored by the codec.
+func (c *Codec) Encoding() string {
+	if c == nil {
+		return Gzip
+	}
+	return c.encoding
+}
+
+// Put compresses the contents of rdr into the named cache object. The length
+// is the number of bytes in rdr or -1 if unknown. Data is streamed through a
+// buffer of bufferSize bytes. The start of the data is sampled and objects
+// which do not compress well are stored as-is.
+func (c *Codec) Put(ctx context.Context, dst cache.Cache, key string, rdr io.Reader, length int64, bufferSize int) error {
+	sample := make([]byte, sampleSize)
+	n, err := io.ReadFull(rdr, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sample = sample[:n]
+	rdr = io.MultiReader(bytes.NewReader(sample), rdr)
+
+	encoding := c.Encoding()
+	if encoding != Identity && !compressible(sample) {
+		encoding = Identity
+	}
+	meta := cache.Metadata{
+		ContentEncoding: encoding,
+		ContentLength:   length,
+	}
+	if encoding == Identity {
+		err = dst.Put(ctx, key, rdr, meta)
+		if err == nil {
+			objectsTotal.WithLabelValues(encoding).Inc()
+		}
+		return err
+	}
+
+	pipeRdr, pipeWrt := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, span := tracing.Start(ctx, "codec.compress")
+		err := c.compress(pipeWrt, rdr, bufferSize)
+		tracing.End(span, err)
+		pipeWrt.CloseWithError(err)
+	}()
+
+	err = dst.Put(ctx, key, pipeRdr, meta)
+
+	// unblock the compressor if the cache stopped reading early and wait for
+	// it to release the reader
+	pipeRdr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err == nil {
+		objectsTotal.WithLabelValues(encoding).Inc()
+	}
+	return err
+}
+
+// PutEncoded stores data which is already encoded with the given encoding
+// without encoding it again. The data is spooled to a temporary file in dir
+// while it is decoded and the decoded data is passed to check, which must read
+// it to the end. The object is stored with its decoded length once the check
+// passes. ErrInvalid is returned if the data cannot be decoded or check
+// returns an error, unless the data could not be read. The system temporary
+// directory is used if dir is empty.
+func PutEncoded(ctx context.Context, dst cache.Cache, key string, rdr io.Reader, encoding, dir string, check func(io.Reader) error) error {
+	if !Supported(encoding) {
+		return fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	tmp, err := ioutil.TempFile(dir, "put-encoded-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	src := &errReader{Reader: io.TeeReader(rdr, tmp)}
+	var length int64
+	err = decodeCheck(ioutil.NopCloser(src), encoding, func(decoded io.Reader) error {
+		counter := &countReader{Reader: decoded}
+		err := check(counter)
+		length = counter.n
+		return err
+	})
+	if err == nil {
+		// data after the end of the encoded stream is not stored
+		var n int64
+		n, err = io.Copy(ioutil.Discard, src)
+		if err == nil && n > 0 {
+			err = ErrInvalid
+		}
+	}
+	if src.err != nil {
+		return src.err
+	} else if err != nil {
+		return ErrInvalid
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = dst.Put(ctx, key, tmp, cache.Metadata{
+		ContentEncoding: encoding,
+		ContentLength:   length,
+	})
+	if err == nil {
+		objectsTotal.WithLabelValues(encoding).Inc()
+	}
+	return err
+}
+
+// decodeCheck passes the decoded contents of rdr to check.
+func decodeCheck(rdr io.ReadCloser, encoding string, check func(io.Reader) error) error {
+	dec, err := Decode(rdr, encoding)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	return check(dec)
+}
+
+// Get returns a reader of the decoded contents of the named cache object. The
+// object is decoded according to its recorded encoding. The caller must close
+// the reader when finished.
+func Get(ctx context.Context, c cache.Cache, key string) (io.ReadCloser, error) {
+	rdr, encoding, err := Open(ctx, c, key)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(rdr, encoding)
+}
+
+// Open returns a reader of the stored contents of the named cache object and
+// the encoding they are stored with. Objects without a recorded encoding are
+// gzip compressed. The object is stat'd for its encoding if the cache's reader
+// does not describe it. The caller must close the reader when finished.
+func Open(ctx context.Context, c cache.Cache, key string) (io.ReadCloser, string, error) {
+	rdr, err := c.Get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	meta, ok := cache.ReaderMetadata(rdr)
+	if !ok {
+		info, err := c.Stat(ctx, key)
+		if err != nil {
+			rdr.Close()
+			return nil, "", err
+		}
+		meta = info.Metadata
+	}
+	if meta.ContentEncoding == "" {
+		return rdr, Gzip, nil
+	}
+	return rdr, meta.ContentEncoding, nil
+}
+
+// Decode returns a reader of the decoded contents of rdr. Closing the returned
+// reader closes rdr. Rdr is closed if an error is returned.
+func Decode(rdr io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	var dec io.ReadCloser
+	var err error
+	switch encoding {
+	case Identity:
+		return rdr, nil
+	case Gzip:
+		dec, err = gzip.NewReader(rdr)
+	case Zstd:
+		var zstdDec *zstd.Decoder
+		zstdDec, err = zstd.NewReader(rdr, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			dec = zstdDec.IOReadCloser()
+		}
+	default:
+		err = fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	return &decoder{
+		ReadCloser: dec,
+		src:        rdr,
+	}, nil
+}
+
+// Supported returns true if objects stored with the encoding can be decoded.
+func Supported(encoding string) bool {
+	switch encoding {
+	case Identity, Gzip, Zstd:
+		return true
+	}
+	return false
+}
+
+// Copy data from rdr to wrt using a buffer of bufferSize bytes.
+func Copy(wrt io.Writer, rdr io.Reader, bufferSize int) (int64, error) {
+	buf := make([]byte, bufferSize)
+	// hide ReaderFrom and WriterTo so that the buffer is always used
+	return io.CopyBuffer(struct{ io.Writer }{wrt}, struct{ io.Reader }{rdr}, buf)
+}
+
+// compress writes the compressed contents of rdr to wrt.
+func (c *Codec) compress(wrt io.Writer, rdr io.Reader, bufferSize int) error {
+	counter := &countWriter{Writer: wrt}
+	enc, err := c.newEncoder(counter)
+	if err != nil {
+		return err
+	}
+	n, err := Copy(enc, rdr, bufferSize)
+	if err != nil {
+		enc.Close()
+		return err
+	}
+	err = enc.Close()
+	if err == nil && counter.n > 0 {
+		compressionRatio.WithLabelValues(c.Encoding()).Observe(float64(n) / float64(counter.n))
+	}
+	return err
+}
+
+// newEncoder returns a writer which compresses the data written to wrt.
+func (c *Codec) newEncoder(wrt io.Writer) (io.WriteCloser, error) {
+	var level int
+	if c != nil {
+		level = c.level
+	}
+	if c.Encoding() == Zstd {
+		zstdLevel := zstd.SpeedDefault
+		if level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(wrt, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(wrt, level)
+}
+
+// compressible returns true if compressing the sample saves at least
+// minSavings of its size. The sample is compressed at the fastest level so
+// that the check is cheap compared to compressing the object.
+func compressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	counter := &countWriter{Writer: ioutil.Discard}
+	wrt, err := flate.NewWriter(counter, flate.BestSpeed)
+	if err != nil {
+		return true
+	}
+	wrt.Write(sample)
+	wrt.Close()
+	return float64(counter.n) <= float64(len(sample))*(1-minSavings)
+}
+
+// errReader records the first error other than io.EOF returned by a reader.
+type errReader struct {
+	io.Reader
+	err error
+}
+
+func (r *errReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// countReader counts the bytes read from a reader.
+type countReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
+
+// decoder closes both the decompressor and its source.
+type decoder struct {
+	io.ReadCloser
+	src io.ReadCloser
+}
+
+func (d *decoder) Close() error {
+	err := d.ReadCloser.Close()
+	srcErr := d.src.Close()
+	if err != nil {
+		return err
+	}
+	return srcErr
+}
@@ -0,0 +1,199 @@
+package codec_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	"github.com/zenreach/hydroponics/internal/cache/memory"
+)
+
+// text is a compressible value larger than the codec's sample.
+var text = bytes.Repeat([]byte("a compressible cache value "), 8*1024)
+
+func newCodec(t *testing.T, cfg codec.Config) *codec.Codec {
+	c, err := codec.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create codec: %s", err)
+	}
+	return c
+}
+
+func put(t *testing.T, cd *codec.Codec, c cache.Cache, key string, value []byte) {
+	err := cd.Put(context.Background(), c, key, bytes.NewReader(value), int64(len(value)), 1024)
+	if err != nil {
+		t.Fatalf("failed to put value: %s", err)
+	}
+}
+
+func assertGet(t *testing.T, c cache.Cache, key string, want []byte) {
+	rdr, err := codec.Get(context.Background(), c, key)
+	if err != nil {
+		t.Fatalf("failed to get value: %s", err)
+	}
+	if have := cachetest.ReadAll(t, rdr); !bytes.Equal(have, want) {
+		t.Errorf("expected %d decoded bytes, got %d", len(want), len(have))
+	}
+}
+
+func assertEncoding(t *testing.T, c cache.Cache, key, want string) *cache.Info {
+	info := cachetest.AssertStat(t, c, key)
+	if info.ContentEncoding != want {
+		t.Errorf("expected encoding %q, got %q", want, info.ContentEncoding)
+	}
+	return info
+}
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  codec.Config
+		want string
+	}{
+		{"default", codec.Config{}, codec.Gzip},
+		{"identity", codec.Config{Encoding: codec.Identity}, codec.Identity},
+		{"gzip", codec.Config{Encoding: codec.Gzip}, codec.Gzip},
+		{"gzip level", codec.Config{Encoding: codec.Gzip, Level: 1}, codec.Gzip},
+		{"zstd", codec.Config{Encoding: codec.Zstd}, codec.Zstd},
+		{"zstd level", codec.Config{Encoding: codec.Zstd, Level: 19}, codec.Zstd},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := memory.New(4*1024*1024, 4*1024*1024)
+			put(t, newCodec(t, test.cfg), c, "key", text)
+			info := assertEncoding(t, c, "key", test.want)
+			if info.ContentLength != int64(len(text)) {
+				t.Errorf("expected content length %d, got %d", len(text), info.ContentLength)
+			}
+			if test.want != codec.Identity && info.Size >= int64(len(text)) {
+				t.Errorf("expected value to be compressed, stored %d bytes", info.Size)
+			}
+			assertGet(t, c, "key", text)
+		})
+	}
+}
+
+func TestNilCodec(t *testing.T) {
+	c := memory.New(4*1024*1024, 4*1024*1024)
+	var cd *codec.Codec
+	put(t, cd, c, "key", text)
+	assertEncoding(t, c, "key", codec.Gzip)
+	assertGet(t, c, "key", text)
+}
+
+func TestIncompressible(t *testing.T) {
+	value := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(value)
+
+	c := memory.New(4*1024*1024, 4*1024*1024)
+	put(t, newCodec(t, codec.Config{Encoding: codec.Zstd}), c, "key", value)
+	assertEncoding(t, c, "key", codec.Identity)
+	cachetest.AssertGet(t, c, "key", value)
+	assertGet(t, c, "key", value)
+}
+
+func TestEmpty(t *testing.T) {
+	c := memory.New(4*1024*1024, 4*1024*1024)
+	put(t, newCodec(t, codec.Config{Encoding: codec.Zstd}), c, "key", nil)
+	assertGet(t, c, "key", []byte{})
+}
+
+func TestUntagged(t *testing.T) {
+	var buf bytes.Buffer
+	wrt := gzip.NewWriter(&buf)
+	wrt.Write(text)
+	wrt.Close()
+
+	// objects stored before encodings were recorded are gzip compressed
+	c := memory.New(4*1024*1024, 4*1024*1024)
+	cachetest.AssertPut(t, c, "key", buf.Bytes())
+	assertEncoding(t, c, "key", "")
+	assertGet(t, c, "key", text)
+}
+
+// opaqueCache returns readers which do not describe their object.
+type opaqueCache struct {
+	cache.Cache
+}
+
+func (c *opaqueCache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	rdr, err := c.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ io.ReadCloser }{rdr}, nil
+}
+
+func TestStatEncoding(t *testing.T) {
+	c := &opaqueCache{Cache: memory.New(4*1024*1024, 4*1024*1024)}
+	put(t, newCodec(t, codec.Config{Encoding: codec.Zstd}), c, "key", text)
+	assertGet(t, c, "key", text)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	configs := []codec.Config{
+		{Encoding: "brotli"},
+		{Encoding: codec.Identity, Level: 1},
+		{Encoding: codec.Gzip, Level: 10},
+		{Encoding: codec.Zstd, Level: -1},
+		{Encoding: codec.Zstd, Level: 23},
+	}
+	for _, cfg := range configs {
+		if _, err := codec.New(cfg); err == nil {
+			t.Errorf("expected error for config %+v", cfg)
+		}
+	}
+}
+
+func TestPutEncoded(t *testing.T) {
+	var buf bytes.Buffer
+	wrt := gzip.NewWriter(&buf)
+	wrt.Write(text)
+	wrt.Close()
+	encoded := buf.Bytes()
+
+	drain := func(rdr io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, rdr)
+		return err
+	}
+	tests := []struct {
+		name  string
+		data  []byte
+		check func(io.Reader) error
+		err   error
+	}{
+		{"valid", encoded, drain, nil},
+		{"truncated", encoded[:len(encoded)/2], drain, codec.ErrInvalid},
+		{"check failed", encoded, func(rdr io.Reader) error {
+			drain(rdr)
+			return errors.New("check failed")
+		}, codec.ErrInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := memory.New(4*1024*1024, 4*1024*1024)
+			err := codec.PutEncoded(context.Background(), c, "key", bytes.NewReader(test.data), codec.Gzip, t.TempDir(), test.check)
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err != nil {
+				cachetest.AssertMiss(t, c, "key")
+				return
+			}
+			assertEncoding(t, c, "key", codec.Gzip)
+			if info := cachetest.AssertStat(t, c, "key"); info.ContentLength != int64(len(text)) {
+				t.Errorf("expected content length %d, got %d", len(text), info.ContentLength)
+			}
+			cachetest.AssertGet(t, c, "key", encoded)
+			assertGet(t, c, "key", text)
+		})
+	}
+}
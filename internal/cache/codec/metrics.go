@@ -0,0 +1,37 @@
+package codec
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	compressionRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hydroponics",
+		Subsystem: "codec",
+		Name:      "compression_ratio",
+		Help:      "Ratio of the decoded size to the stored size of objects put in the cache.",
+		Buckets:   []float64{1, 1.25, 1.5, 2, 3, 4, 6, 8, 12, 16, 32},
+	}, []string{"encoding"})
+
+	objectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "codec",
+		Name:      "objects_total",
+		Help:      "Objects put in the cache by stored content encoding.",
+	}, []string{"encoding"})
+)
+
+// countWriter counts the bytes written to a writer.
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(buf []byte) (int, error) {
+	n, err := w.Writer.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,448 @@
+package disk
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zenreach/hydroponics/internal/cache"
+)
+
+const (
+	// objectsDir holds cached objects.
+	objectsDir = "objects"
+
+	// tmpDir holds objects which are being written.
+	tmpDir = "tmp"
+
+	// maxHeaderSize is the maximum size of an object header.
+	maxHeaderSize = 64 * 1024
+)
+
+// Cache implements a cache stored in a local directory. The total size of the
+// stored objects is bounded. The least recently accessed objects are evicted
+// when the bound is exceeded.
+//
+// Each object is stored in its own file. Files are written to a temporary
+// location and renamed into place so that a partially written object is never
+// visible. A file's modification time records when the object was last
+// accessed so that the eviction order survives restarts.
+type Cache struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	size    int64                    // total size of all objects
+	lru     *list.List               // entries ordered by access, most recent first
+	entries map[string]*list.Element // index of entries by key
+}
+
+// entry is an object in the index.
+type entry struct {
+	key  string
+	size int64
+}
+
+// header is written at the start of each object file.
+type header struct {
+	ContentEncoding string    `json:"content_encoding,omitempty"`
+	ContentLength   int64     `json:"content_length"`
+	Modified        time.Time `json:"modified"`
+}
+
+// New returns a cache which stores up to maxSize bytes of objects in dir. The
+// directory is created if it does not exist. Existing objects in the directory
+// are indexed and evicted if they exceed the size bound.
+func New(dir string, maxSize int64) (*Cache, error) {
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	// discard objects from writes which did not complete
+	err := os.RemoveAll(filepath.Join(dir, tmpDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "disk cache")
+	}
+	for _, name := range []string{objectsDir, tmpDir} {
+		err = os.MkdirAll(filepath.Join(dir, name), 0755)
+		if err != nil {
+			return nil, errors.Wrap(err, "disk cache")
+		}
+	}
+
+	err = c.rebuild()
+	if err != nil {
+		return nil, errors.Wrap(err, "disk cache")
+	}
+	return c, nil
+}
+
+// rebuild the index from the objects on disk.
+func (c *Cache) rebuild() error {
+	type found struct {
+		key      string
+		size     int64
+		accessed time.Time
+	}
+	var objects []found
+	var misplaced []string // objects stored in an older layout
+	root := filepath.Join(c.dir, objectsDir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		key, err := decodeKey(info.Name())
+		if err != nil {
+			// not a cache object; leave it alone
+			return nil
+		}
+		if path != c.path(key) {
+			misplaced = append(misplaced, path)
+		}
+		objects = append(objects, found{
+			key:      key,
+			size:     info.Size(),
+			accessed: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range misplaced {
+		key, _ := decodeKey(filepath.Base(path))
+		want := c.path(key)
+		err = os.MkdirAll(filepath.Dir(want), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(path, want)
+		if err != nil {
+			return err
+		}
+	}
+
+	// add the least recently accessed objects first so that they end up at
+	// the back of the list
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].accessed.Before(objects[j].accessed)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, obj := range objects {
+		c.add(obj.key, obj.size)
+	}
+	c.evict()
+	return nil
+}
+
+func (c *Cache) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	file, hdr, err := c.open(key)
+	if err != nil {
+		return nil, err
+	}
+	c.access(key)
+	return &object{
+		Reader: io.LimitReader(file, hdr.size),
+		file:   file,
+		meta: cache.Metadata{
+			ContentEncoding: hdr.ContentEncoding,
+			ContentLength:   hdr.ContentLength,
+		},
+	}, nil
+}
+
+// GetRange seeks past the data before the offset.
+func (c *Cache) GetRange(_ context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	file, hdr, err := c.open(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset > hdr.size {
+		offset = hdr.size
+	}
+	_, err = file.Seek(offset, io.SeekCurrent)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "disk cache")
+	}
+	size := hdr.size - offset
+	if length >= 0 && length < size {
+		size = length
+	}
+	c.access(key)
+	return &object{
+		Reader: io.LimitReader(file, size),
+		file:   file,
+		meta: cache.Metadata{
+			ContentEncoding: hdr.ContentEncoding,
+			ContentLength:   hdr.ContentLength,
+		},
+	}, nil
+}
+
+func (c *Cache) Stat(_ context.Context, key string) (*cache.Info, error) {
+	file, hdr, err := c.open(key)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &cache.Info{
+		Metadata: cache.Metadata{
+			ContentEncoding: hdr.ContentEncoding,
+			ContentLength:   hdr.ContentLength,
+		},
+		Size:         hdr.size,
+		LastModified: hdr.Modified,
+	}, nil
+}
+
+// Put writes the object to a temporary file and moves it into place once it
+// is complete. Objects larger than the cache are discarded along with any
+// object they replace.
+func (c *Cache) Put(_ context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
+	tmp, err := ioutil.TempFile(filepath.Join(c.dir, tmpDir), "put-")
+	if err != nil {
+		return errors.Wrap(err, "disk cache")
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := writeObject(tmp, rdr, meta)
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, "disk cache")
+	}
+	if size > c.maxSize {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+		}
+		return nil
+	}
+
+	path := c.path(key)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrap(err, "disk cache")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrap(err, "disk cache")
+	}
+	c.add(key, size)
+	c.evict()
+	return nil
+}
+
+// MaxObjectSize returns the size of the cache as larger objects are discarded.
+func (c *Cache) MaxObjectSize() int64 {
+	return c.maxSize
+}
+
+// Size returns the total size of the objects in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// open the object file and read its header. The returned file is positioned
+// at the start of the object data.
+func (c *Cache) open(key string) (*os.File, *fileHeader, error) {
+	c.mu.Lock()
+	_, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil, nil, cache.ErrCacheMiss
+	}
+
+	file, err := os.Open(c.path(key))
+	if os.IsNotExist(err) {
+		// evicted after the index was checked
+		return nil, nil, cache.ErrCacheMiss
+	} else if err != nil {
+		return nil, nil, errors.Wrap(err, "disk cache")
+	}
+	hdr, err := readHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, errors.Wrap(err, "disk cache")
+	}
+	return file, hdr, nil
+}
+
+// access marks the object as the most recently used.
+func (c *Cache) access(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+}
+
+// add an object to the index as the most recently used. The caller must hold
+// the lock.
+func (c *Cache) add(key string, size int64) {
+	if elem, ok := c.entries[key]; ok {
+		ent := elem.Value.(*entry)
+		c.size += size - ent.size
+		ent.size = size
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&entry{
+		key:  key,
+		size: size,
+	})
+	c.size += size
+}
+
+// evict the least recently used objects until the cache is within its size
+// bound. The caller must hold the lock.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		elem := c.lru.Back()
+		if elem == nil {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+// remove an object and its file. The caller must hold the lock.
+func (c *Cache) remove(elem *list.Element) {
+	ent := elem.Value.(*entry)
+	os.Remove(c.path(ent.key))
+	c.lru.Remove(elem)
+	delete(c.entries, ent.key)
+	c.size -= ent.size
+}
+
+// path returns the location of the object file. Objects are spread evenly
+// across 256 subdirectories named by the first byte of the SHA-256 digest of
+// the key to keep directory sizes manageable.
+func (c *Cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, objectsDir, hex.EncodeToString(sum[:1]), encodeKey(key))
+}
+
+// encodeKey returns a file name which uniquely represents the key.
+func encodeKey(key string) string {
+	return "k" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeKey returns the key represented by a file name.
+func decodeKey(name string) (string, error) {
+	if len(name) == 0 || name[0] != 'k' {
+		return "", errors.New("invalid object name")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(name[1:])
+	return string(key), err
+}
+
+// fileHeader is a header read from an object file.
+type fileHeader struct {
+	header
+	size int64 // size of the object data following the header
+}
+
+// writeObject writes the header and object data to the file. Returns the
+// total number of bytes written.
+func writeObject(file *os.File, rdr io.Reader, meta cache.Metadata) (int64, error) {
+	// the time is stored in whole seconds so that the headers of objects with
+	// the same metadata are the same size
+	data, err := json.Marshal(&header{
+		ContentEncoding: meta.ContentEncoding,
+		ContentLength:   meta.ContentLength,
+		Modified:        time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return 0, err
+	}
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(len(data)))
+	_, err = file.Write(append(prefix, data...))
+	if err != nil {
+		return 0, errors.Wrap(err, "disk cache")
+	}
+
+	n, err := io.Copy(file, rdr)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(prefix)+len(data)) + n, nil
+}
+
+// readHeader reads the header from the start of an object file.
+func readHeader(file *os.File) (*fileHeader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 4)
+	_, err = io.ReadFull(file, prefix)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix)
+	if length > maxHeaderSize {
+		return nil, errors.New("invalid object header")
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &fileHeader{
+		size: info.Size() - int64(len(prefix)) - int64(length),
+	}
+	err = json.Unmarshal(data, &hdr.header)
+	if err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// object is a reader of an object file's data.
+type object struct {
+	io.Reader
+	file *os.File
+	meta cache.Metadata
+}
+
+func (o *object) Metadata() cache.Metadata {
+	return o.meta
+}
+
+func (o *object) Close() error {
+	return o.file.Close()
+}
@@ -0,0 +1,132 @@
+package disk_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/disk"
+)
+
+func newCache(t *testing.T, dir string, maxSize int64) *disk.Cache {
+	c, err := disk.New(dir, maxSize)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	return c
+}
+
+func TestCommon(t *testing.T) {
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		return newCache(t, t.TempDir(), 1024*1024)
+	})
+}
+
+func TestExpire(t *testing.T) {
+	dir := t.TempDir()
+	value := make([]byte, 100)
+
+	// measure the size of an object on disk
+	c := newCache(t, t.TempDir(), 1024)
+	cachetest.AssertPut(t, c, "key1", value)
+	objectSize := c.Size()
+
+	// room for two objects
+	c = newCache(t, dir, 2*objectSize)
+	cachetest.AssertPut(t, c, "key1", value)
+	cachetest.AssertPut(t, c, "key2", value)
+
+	// access a key to ensure it stays in the cache
+	cachetest.AssertGet(t, c, "key1", value)
+
+	// add a value to evict a key
+	cachetest.AssertPut(t, c, "key3", value)
+
+	// verify cache contents
+	cachetest.AssertGet(t, c, "key1", value)
+	cachetest.AssertMiss(t, c, "key2")
+	cachetest.AssertGet(t, c, "key3", value)
+	if size := c.Size(); size != 2*objectSize {
+		t.Errorf("expected cache size %d, got %d", 2*objectSize, size)
+	}
+}
+
+func TestOversize(t *testing.T) {
+	c := newCache(t, t.TempDir(), 10)
+	cachetest.AssertPut(t, c, "large", make([]byte, 100))
+	cachetest.AssertMiss(t, c, "large")
+}
+
+func TestOversizeReplace(t *testing.T) {
+	c := newCache(t, t.TempDir(), 200)
+
+	// replacing an object with one too large to cache removes the old object
+	cachetest.AssertPut(t, c, "key", []byte("old"))
+	cachetest.AssertPut(t, c, "key", make([]byte, 500))
+	cachetest.AssertMiss(t, c, "key")
+	if size := c.Size(); size != 0 {
+		t.Errorf("expected cache size 0, got %d", size)
+	}
+}
+
+func TestShards(t *testing.T) {
+	dir := t.TempDir()
+	c := newCache(t, dir, 1024*1024)
+
+	// keys with a common prefix are spread across shard directories
+	for i := 0; i < 64; i++ {
+		cachetest.AssertPut(t, c, fmt.Sprintf("cas/%064x", i), []byte("value"))
+	}
+	shards, err := ioutil.ReadDir(filepath.Join(dir, "objects"))
+	if err != nil {
+		t.Fatalf("failed to read objects: %s", err)
+	}
+	if len(shards) < 32 {
+		t.Errorf("expected at least 32 shards, got %d", len(shards))
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	dir := t.TempDir()
+	c := newCache(t, dir, 1024*1024)
+	cachetest.AssertPut(t, c, "key1", []byte("value1"))
+	cachetest.AssertPut(t, c, "key/2", []byte("value2"))
+	size := c.Size()
+
+	// a new cache in the same directory finds the existing objects
+	c = newCache(t, dir, 1024*1024)
+	cachetest.AssertGet(t, c, "key1", []byte("value1"))
+	cachetest.AssertGet(t, c, "key/2", []byte("value2"))
+	if have := c.Size(); have != size {
+		t.Errorf("expected cache size %d, got %d", size, have)
+	}
+}
+
+func TestRebuildLayout(t *testing.T) {
+	dir := t.TempDir()
+	c := newCache(t, dir, 1024*1024)
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+
+	// move the object out of its shard as an older layout would store it
+	root := filepath.Join(dir, "objects")
+	shards, err := ioutil.ReadDir(root)
+	if err != nil || len(shards) != 1 {
+		t.Fatalf("expected one shard, got %d: %v", len(shards), err)
+	}
+	names, err := ioutil.ReadDir(filepath.Join(root, shards[0].Name()))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("expected one object, got %d: %v", len(names), err)
+	}
+	err = os.Rename(filepath.Join(root, shards[0].Name(), names[0].Name()), filepath.Join(root, names[0].Name()))
+	if err != nil {
+		t.Fatalf("failed to move object: %s", err)
+	}
+
+	// the object is moved back into its shard
+	c = newCache(t, dir, 1024*1024)
+	cachetest.AssertGet(t, c, "key", []byte("value"))
+}
@@ -1,48 +1,199 @@
 package httphandler
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/auth"
 	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	"github.com/zenreach/hydroponics/internal/digest"
+	"github.com/zenreach/hydroponics/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 )
 
-func New(cas cache.Cache, ac cache.Cache, timeout time.Duration, logger hatchet.Logger) http.Handler {
-	mux := http.NewServeMux()
-	mux.Handle("/cas/", &cacheHandler{
-		Cache:   cas,
-		Timeout: timeout,
-		Logger:  logger,
-	})
-	mux.Handle("/ac/", &cacheHandler{
-		Cache:   ac,
-		Timeout: timeout,
-		Logger:  logger,
-	})
-	return mux
-}
+// DefaultBufferSize is the default size of the buffer used to copy request
+// and response bodies.
+const DefaultBufferSize = 32 * 1024
 
-type cacheHandler struct {
-	Cache   cache.Cache
+// Config configures the cache handler.
+type Config struct {
+	// Timeout is the maximum duration of a cache operation. A zero value
+	// disables the timeout.
 	Timeout time.Duration
-	Logger  hatchet.Logger
+
+	// BufferSize is the size of the buffer used to stream each request and
+	// response body. Defaults to DefaultBufferSize.
+	BufferSize int
+
+	// UploadDir is the directory in which uploads sent with a Content-Encoding
+	// are spooled while they are checked. Defaults to the system temporary
+	// directory.
+	UploadDir string
+
+	// Digest is the hash function of CAS and AC keys. Requests for keys which
+	// are not digests of this function are rejected and CAS uploads are
+	// verified against their key. Defaults to digest.SHA256.
+	Digest *digest.Function
+
+	// PipelineHeader is the request header which identifies the build
+	// pipeline in metrics. Metrics are not labeled by pipeline if it is empty.
+	PipelineHeader string
+
+	// Instances are served in addition to the CAS and AC passed to New.
+	// Requests for any other instance are rejected.
+	Instances []Instance
+
+	// CASCodec and ACCodec compress the objects put into the CAS and AC of
+	// every instance. Defaults to the default codec.
+	CASCodec *codec.Codec
+	ACCodec  *codec.Codec
+}
+
+// Instance is a named pair of CAS and AC caches. It is served under
+// /<name>/cas/ and /<name>/ac/ so that builds which must not share a cache can
+// be served by one handler.
+type Instance struct {
+	Name string
+	CAS  cache.Cache
+	AC   cache.Cache
 }
 
-func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, key := path.Split(r.URL.Path)
-	if key == "" {
+// New returns a handler which serves the Bazel HTTP cache protocol from the
+// CAS and AC caches under /cas/ and /ac/ and from each of the instances in the
+// config. Requests for an instance which is not configured are rejected with
+// 403 Forbidden. Objects are stored compressed by the codec of their namespace
+// and decoded according to the encoding recorded when they were stored. A
+// single byte range of the decoded object is served to requests with a Range
+// header. Request and response bodies are streamed to and from the cache so
+// memory use does not depend on the size of the object. Keys must be hex
+// digests of the configured digest function or the request is rejected with
+// 400 Bad Request. CAS uploads are rejected unless their digest matches their
+// key. Requests are rejected with 403 Forbidden unless the principal
+// authenticated by auth.Handler has permission to read or write the cache.
+func New(cas cache.Cache, ac cache.Cache, cfg Config, logger hatchet.Logger) http.Handler {
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	digestFn := cfg.Digest
+	if digestFn == nil {
+		digestFn = digest.SHA256
+	}
+
+	rt := &router{
+		instances: map[string]map[string]*cacheHandler{},
+		logger:    logger,
+	}
+	instances := append([]Instance{{CAS: cas, AC: ac}}, cfg.Instances...)
+	for _, inst := range instances {
+		rt.instances[inst.Name] = map[string]*cacheHandler{
+			"cas": {
+				Instance:       inst.Name,
+				Namespace:      "cas",
+				Cache:          inst.CAS,
+				Codec:          cfg.CASCodec,
+				Read:           auth.ReadCAS,
+				Write:          auth.WriteCAS,
+				Timeout:        cfg.Timeout,
+				BufferSize:     bufferSize,
+				UploadDir:      cfg.UploadDir,
+				Digest:         digestFn,
+				Verify:         true,
+				PipelineHeader: cfg.PipelineHeader,
+				Logger:         logger,
+			},
+			"ac": {
+				Instance:       inst.Name,
+				Namespace:      "ac",
+				Cache:          inst.AC,
+				Codec:          cfg.ACCodec,
+				Read:           auth.ReadAC,
+				Write:          auth.WriteAC,
+				Timeout:        cfg.Timeout,
+				BufferSize:     bufferSize,
+				UploadDir:      cfg.UploadDir,
+				Digest:         digestFn,
+				PipelineHeader: cfg.PipelineHeader,
+				Logger:         logger,
+			},
+		}
+	}
+	return rt
+}
+
+// router sends each request to the handler of its instance and namespace.
+type router struct {
+	instances map[string]map[string]*cacheHandler
+	logger    hatchet.Logger
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	instance, namespace, key, ok := splitPath(r.URL.Path)
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	namespaces, ok := rt.instances[instance]
+	if !ok {
+		rt.logger.Log(hatchet.L{
+			"message":  "unknown instance",
+			"level":    "info",
+			"instance": instance,
+		})
+		httpError(w, http.StatusForbidden)
+		return
+	}
+	h, ok := namespaces[namespace]
+	if !ok {
 		httpError(w, http.StatusNotFound)
 		return
 	}
+	h.serve(w, r, key)
+}
+
+// splitPath splits a request path of the form /<instance>/<namespace>/<key>.
+// The instance may contain slashes and is empty for /<namespace>/<key>.
+func splitPath(p string) (instance, namespace, key string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	n := len(parts)
+	if n < 2 || parts[n-1] == "" {
+		return "", "", "", false
+	}
+	return strings.Join(parts[:n-2], "/"), parts[n-2], parts[n-1], true
+}
 
-	ctx := context.Background()
+type cacheHandler struct {
+	Instance       string
+	Namespace      string
+	Cache          cache.Cache
+	Codec          *codec.Codec
+	Read           auth.Permission // required by HEAD and GET
+	Write          auth.Permission // required by PUT
+	Timeout        time.Duration
+	BufferSize     int
+	UploadDir      string
+	Digest         *digest.Function // validates keys
+	Verify         bool             // verify uploads against their key
+	PipelineHeader string
+	Logger         hatchet.Logger
+}
+
+// serve a request for the object with the given key.
+func (h *cacheHandler) serve(w http.ResponseWriter, r *http.Request, key string) {
+	// the request is cancelled if the client goes away
+	ctx := r.Context()
 	if h.Timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
@@ -53,94 +204,408 @@ func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		rdr, err := h.Cache.Get(ctx, key)
-		if err == cache.ErrCacheMiss {
+	start := time.Now()
+	var pipeline string
+	if h.PipelineHeader != "" {
+		pipeline = r.Header.Get(h.PipelineHeader)
+	}
+
+	// continue the client's trace if it sent one
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Start(ctx, "cache "+r.Method,
+		attribute.String("cache.instance", h.Instance),
+		attribute.String("cache.namespace", h.Namespace),
+		attribute.String("cache.key", key),
+		attribute.String("http.method", r.Method),
+	)
+	defer span.End()
+
+	var result string
+	switch {
+	case !auth.Permissions(ctx).Has(h.permission(r.Method)):
+		result = h.deny(ctx, w, r.Method, key)
+	case !h.Digest.Valid(key):
+		h.logDebug(key, "invalid key")
+		httpError(w, http.StatusBadRequest)
+		result = resultRejected
+	case r.Method == http.MethodHead:
+		result = h.head(ctx, w, key)
+	case r.Method == http.MethodGet:
+		result = h.get(ctx, w, r, key, pipeline)
+	case r.Method == http.MethodPut:
+		result = h.put(ctx, w, r, key, pipeline)
+	default:
+		httpError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	span.SetAttributes(attribute.String("cache.result", result))
+	if result == resultError {
+		span.SetStatus(codes.Error, "cache error")
+	}
+	requestsTotal.WithLabelValues(h.Instance, h.Namespace, r.Method, pipeline, result).Inc()
+	requestDuration.WithLabelValues(h.Namespace, r.Method).Observe(time.Since(start).Seconds())
+}
+
+// permission returns the permission required by the request method.
+func (h *cacheHandler) permission(method string) auth.Permission {
+	if method == http.MethodPut {
+		return h.Write
+	}
+	return h.Read
+}
+
+// deny rejects a request which the principal is not allowed to make.
+func (h *cacheHandler) deny(ctx context.Context, w http.ResponseWriter, method, key string) string {
+	h.Logger.Log(hatchet.L{
+		"message":   "permission denied",
+		"key":       key,
+		"level":     "info",
+		"instance":  h.Instance,
+		"namespace": h.Namespace,
+		"method":    method,
+		"principal": auth.Principal(ctx),
+	})
+	httpError(w, http.StatusForbidden)
+	return resultDenied
+}
+
+// head responds with the decompressed length of the object if it exists.
+func (h *cacheHandler) head(ctx context.Context, w http.ResponseWriter, key string) string {
+	info, err := h.Cache.Stat(ctx, key)
+	if cache.IsMiss(err) {
+		h.logDebug(key, "cache miss")
+		w.WriteHeader(http.StatusNotFound)
+		return resultMiss
+	} else if err != nil {
+		h.logError(err, key, "cache error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return resultError
+	}
+
+	if info.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	h.logDebug(key, "cache hit")
+	return resultHit
+}
+
+// get streams the object to the response. The stored bytes are sent as-is if
+// the client accepts their encoding and are decompressed otherwise. A single
+// byte range of the decompressed object is sent if one is requested by a
+// Range header and the If-Range condition, if any, holds. Other Range headers
+// are ignored.
+func (h *cacheHandler) get(ctx context.Context, w http.ResponseWriter, r *http.Request, key, pipeline string) string {
+	w.Header().Set("Vary", "Accept-Encoding")
+	if r.Header.Get("Range") != "" {
+		info, err := h.Cache.Stat(ctx, key)
+		if cache.IsMiss(err) {
 			h.logDebug(key, "cache miss")
 			httpError(w, http.StatusNotFound)
-			return
+			return resultMiss
 		} else if err != nil {
 			h.logError(err, key, "cache error")
 			httpError(w, http.StatusInternalServerError)
-			return
+			return resultError
 		}
-		defer rdr.Close()
-
-		var b1 bytes.Buffer
-		_, err = io.Copy(&b1, rdr)
-		if err != nil {
-			h.logError(err, key, "i/o error")
-			return
+		size := decodedSize(info)
+		if size >= 0 && h.ifRange(r.Header.Get("If-Range"), key, info) {
+			rng, err := parseRange(r.Header.Get("Range"), size)
+			if err == errUnsatisfiable {
+				h.logDebug(key, "unsatisfiable range")
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				httpError(w, http.StatusRequestedRangeNotSatisfiable)
+				return resultRejected
+			} else if err == nil {
+				return h.getRange(ctx, w, key, pipeline, info, rng, size)
+			}
 		}
+	}
 
-		gzRdr, err := gzip.NewReader(&b1)
-		if err != nil {
-			h.logError(err, key, "gzip error")
-			return
-		}
+	rdr, encoding, err := codec.Open(ctx, h.Cache, key)
+	if cache.IsMiss(err) {
+		h.logDebug(key, "cache miss")
+		httpError(w, http.StatusNotFound)
+		return resultMiss
+	} else if err != nil {
+		h.logError(err, key, "cache error")
+		httpError(w, http.StatusInternalServerError)
+		return resultError
+	}
 
-		b2, err := ioutil.ReadAll(gzRdr)
-		if err != nil {
-			h.logError(err, key, "gzip i/o error")
-			return
-		}
-		err = gzRdr.Close()
+	if encoding != codec.Identity && acceptsEncoding(r.Header.Get("Accept-Encoding"), encoding) {
+		w.Header().Set("Content-Encoding", encoding)
+	} else {
+		rdr, err = codec.Decode(rdr, encoding)
 		if err != nil {
-			h.logError(err, key, "gzip error")
-			return
+			h.logError(err, key, "cache error")
+			httpError(w, http.StatusInternalServerError)
+			return resultError
 		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		h.setETag(w.Header(), key)
+	}
+	defer rdr.Close()
+	return h.send(ctx, w, rdr, http.StatusOK, key, pipeline)
+}
 
-		w.WriteHeader(http.StatusOK)
-		_, err = io.Copy(w, bytes.NewBuffer(b2))
-		if err != nil {
-			h.logError(err, key, "write error")
-			return
-		}
-		h.logDebug(key, "cache hit")
-	case http.MethodPut:
-		var b bytes.Buffer
-		gzWrt, err := gzip.NewWriterLevel(&b, gzip.BestCompression)
-		if err != nil {
-			h.logError(err, key, "gzip error")
-			return
+// getRange streams a byte range of the decompressed object to the response.
+// The range is read directly from the cache if the object is stored as-is.
+// Compressed objects are decoded from the start and the bytes before the range
+// are discarded.
+func (h *cacheHandler) getRange(ctx context.Context, w http.ResponseWriter, key, pipeline string, info *cache.Info, rng byteRange, size int64) string {
+	var rdr io.ReadCloser
+	var err error
+	if info.ContentEncoding == codec.Identity {
+		rdr, err = cache.GetRange(ctx, h.Cache, key, rng.start, rng.length)
+	} else {
+		rdr, err = codec.Get(ctx, h.Cache, key)
+		if err == nil {
+			_, err = io.CopyN(ioutil.Discard, rdr, rng.start)
+			if err != nil {
+				rdr.Close()
+			}
 		}
+	}
+	if cache.IsMiss(err) {
+		h.logDebug(key, "cache miss")
+		httpError(w, http.StatusNotFound)
+		return resultMiss
+	} else if err != nil {
+		h.logError(err, key, "cache error")
+		httpError(w, http.StatusInternalServerError)
+		return resultError
+	}
+	rdr = cache.LimitReadCloser(rdr, rng.length)
+	defer rdr.Close()
 
-		_, err = io.Copy(gzWrt, r.Body)
-		if err != nil {
-			h.logError(err, key, "write error")
-			return
-		}
-		gzWrt.Close()
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.start+rng.length-1, size))
+	header.Set("Content-Length", strconv.FormatInt(rng.length, 10))
+	if !info.LastModified.IsZero() {
+		header.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	h.setETag(header, key)
+	return h.send(ctx, w, rdr, http.StatusPartialContent, key, pipeline)
+}
 
-		err = h.Cache.Put(ctx, key, &b)
-		if err != nil {
-			h.logError(err, key, "cache error")
-			httpError(w, http.StatusInternalServerError)
+// send streams the body of a successful response.
+func (h *cacheHandler) send(ctx context.Context, w http.ResponseWriter, rdr io.Reader, code int, key, pipeline string) string {
+	// errors past this point can only be reported by aborting the response
+	w.WriteHeader(code)
+	_, span := tracing.Start(ctx, "stream response")
+	n, err := codec.Copy(w, rdr, h.BufferSize)
+	span.SetAttributes(attribute.Int64("cache.bytes", n))
+	tracing.End(span, err)
+	sentBytes.WithLabelValues(h.Namespace, pipeline).Add(float64(n))
+	if err != nil {
+		h.logError(err, key, "i/o error")
+		return resultError
+	}
+	h.logDebug(key, "cache hit")
+	return resultHit
+}
+
+// setETag sets the entity tag of the decompressed object. Only CAS objects
+// have one as they cannot change without changing their key.
+func (h *cacheHandler) setETag(header http.Header, key string) {
+	if h.Verify {
+		header.Set("ETag", strconv.Quote(key))
+	}
+}
+
+// ifRange returns true if an If-Range header value is empty or matches the
+// object. An entity tag matches the ETag of a CAS object and a date matches
+// the modification time of the object to the second.
+func (h *cacheHandler) ifRange(value, key string, info *cache.Info) bool {
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		// weak entity tags never match
+		return h.Verify && value == strconv.Quote(key)
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || info.LastModified.IsZero() {
+		return false
+	}
+	return info.LastModified.Truncate(time.Second).Equal(date)
+}
+
+// put streams the request body into the cache while compressing it. A body
+// sent with a supported Content-Encoding is stored as-is once it has been
+// spooled and decompressed to check it and measure its decoded length. If the
+// handler verifies uploads then the body is hashed as it is streamed and the
+// object is discarded if it does not match the key.
+func (h *cacheHandler) put(ctx context.Context, w http.ResponseWriter, r *http.Request, key, pipeline string) string {
+	if r.Body == nil {
+		httpError(w, http.StatusBadRequest)
+		return resultRejected
+	}
+	encoding := strings.ToLower(r.Header.Get("Content-Encoding"))
+	if encoding == "" {
+		encoding = codec.Identity
+	}
+	if !codec.Supported(encoding) {
+		h.logDebug(key, "unsupported content encoding")
+		httpError(w, http.StatusUnsupportedMediaType)
+		return resultRejected
+	}
+
+	counter := &countReader{Reader: r.Body}
+	defer func() {
+		receivedBytes.WithLabelValues(h.Namespace, pipeline).Add(float64(counter.n))
+	}()
+
+	var ver *digest.Verifier
+	var err error
+	if encoding == codec.Identity {
+		var body io.Reader = counter
+		if h.Verify {
+			ver = h.Digest.NewVerifier(body, key, r.ContentLength)
+			body = ver
 		}
-		h.logDebug(key, "cache put")
-	default:
-		httpError(w, http.StatusMethodNotAllowed)
+		err = h.Codec.Put(ctx, h.Cache, key, body, r.ContentLength, h.BufferSize)
+	} else {
+		err = codec.PutEncoded(ctx, h.Cache, key, counter, encoding, h.UploadDir, func(decoded io.Reader) error {
+			if h.Verify {
+				ver = h.Digest.NewVerifier(decoded, key, -1)
+				decoded = ver
+			}
+			_, err := codec.Copy(ioutil.Discard, decoded, h.BufferSize)
+			return err
+		})
+	}
+	if ver != nil && ver.Mismatch() {
+		h.logDebug(key, "digest mismatch")
+		httpError(w, http.StatusBadRequest)
+		return resultRejected
+	} else if err == codec.ErrInvalid {
+		h.logDebug(key, "invalid content encoding")
+		httpError(w, http.StatusBadRequest)
+		return resultRejected
+	} else if err != nil {
+		h.logError(err, key, "cache error")
+		httpError(w, http.StatusInternalServerError)
+		return resultError
 	}
+	h.logDebug(key, "cache put")
+	return resultStored
 }
 
 func (h *cacheHandler) logDebug(key, msg string) {
 	h.Logger.Log(hatchet.L{
-		"message": msg,
-		"key":     key,
-		"level":   "debug",
+		"message":  msg,
+		"key":      key,
+		"level":    "debug",
+		"instance": h.Instance,
 	})
 }
 
 func (h *cacheHandler) logError(err error, key, msg string) {
 	h.Logger.Log(hatchet.L{
-		"message": msg,
-		"key":     key,
-		"level":   "error",
-		"error":   err,
+		"message":  msg,
+		"key":      key,
+		"level":    "error",
+		"error":    err,
+		"instance": h.Instance,
 	})
 }
 
+// acceptsEncoding returns true if an Accept-Encoding header value names the
+// content encoding with a non-zero quality.
+func acceptsEncoding(header, encoding string) bool {
+	for _, value := range strings.Split(header, ",") {
+		params := strings.Split(value, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), encoding) {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// byteRange is a range of bytes of an object.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// errUnsatisfiable is returned by parseRange if the range does not overlap the
+// object.
+var errUnsatisfiable = errors.New("unsatisfiable range")
+
+// parseRange parses a Range header value requesting a single byte range of an
+// object of the given size. The range is clipped to the end of the object.
+// Values which request several ranges or cannot be parsed return an error
+// other than errUnsatisfiable.
+func parseRange(value string, size int64) (byteRange, error) {
+	const unit = "bytes="
+	if len(value) < len(unit) || !strings.EqualFold(value[:len(unit)], unit) {
+		return byteRange{}, errors.New("unsupported range unit")
+	}
+	spec := strings.TrimSpace(value[len(unit):])
+	if strings.Contains(spec, ",") {
+		return byteRange{}, errors.New("multiple ranges")
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return byteRange{}, errors.New("invalid range")
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if first == "" {
+		// suffix range of the last bytes of the object
+		n, err := strconv.ParseUint(last, 10, 63)
+		if err != nil {
+			return byteRange{}, errors.New("invalid range")
+		}
+		length := int64(n)
+		if length > size {
+			length = size
+		}
+		if length == 0 {
+			return byteRange{}, errUnsatisfiable
+		}
+		return byteRange{start: size - length, length: length}, nil
+	}
+
+	start, err := strconv.ParseUint(first, 10, 63)
+	if err != nil {
+		return byteRange{}, errors.New("invalid range")
+	}
+	end := uint64(size) - 1
+	if last != "" {
+		end, err = strconv.ParseUint(last, 10, 63)
+		if err != nil || end < start {
+			return byteRange{}, errors.New("invalid range")
+		}
+	}
+	if int64(start) >= size {
+		return byteRange{}, errUnsatisfiable
+	}
+	if int64(end) >= size {
+		end = uint64(size) - 1
+	}
+	return byteRange{start: int64(start), length: int64(end-start) + 1}, nil
+}
+
+// decodedSize returns the size of the decompressed object or -1 if unknown.
+func decodedSize(info *cache.Info) int64 {
+	if info.ContentLength < 0 && info.ContentEncoding == codec.Identity {
+		return info.Size
+	}
+	return info.ContentLength
+}
+
 func httpError(w http.ResponseWriter, code int) {
 	http.Error(w, http.StatusText(code), code)
 }
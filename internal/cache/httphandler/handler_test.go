@@ -3,19 +3,33 @@ package httphandler_test
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/auth"
 	"github.com/zenreach/hydroponics/internal/cache"
 	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
 	"github.com/zenreach/hydroponics/internal/cache/httphandler"
 	"github.com/zenreach/hydroponics/internal/cache/memory"
+	"github.com/zenreach/hydroponics/internal/digest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type service struct {
@@ -37,15 +51,18 @@ func Setup(t *testing.T) *testEnv {
 		T: t,
 		CAS: &service{
 			Name:  "cas",
-			Cache: memory.New(10),
+			Cache: memory.New(64*1024*1024, 16*1024*1024),
 		},
 		AC: &service{
 			Name:  "ac",
-			Cache: memory.New(10),
+			Cache: memory.New(64*1024*1024, 16*1024*1024),
 		},
 		Client: &http.Client{},
 	}
-	handler := httphandler.New(te.CAS.Cache, te.AC.Cache, 15*time.Second, hatchet.Test(t))
+	handler := httphandler.New(te.CAS.Cache, te.AC.Cache, httphandler.Config{
+		Timeout:    15 * time.Second,
+		BufferSize: 1024,
+	}, hatchet.Test(t))
 	te.Server = httptest.NewServer(handler)
 	return te
 }
@@ -85,15 +102,24 @@ func (te *testEnv) GetValue(svc *service, key string) []byte {
 	return nil
 }
 
+func (te *testEnv) Head(svc *service, key string) *http.Response {
+	res, err := te.Client.Head(te.URL(svc, key))
+	if err != nil {
+		te.Fatalf("client error: %s", err)
+	}
+	return res
+}
+
 func (te *testEnv) Put(svc *service, key string, value []byte) *http.Response {
 	uri, err := url.Parse(te.URL(svc, key))
 	if err != nil {
 		te.Fatalf("uri error: %s", err)
 	}
 	res, err := te.Client.Do(&http.Request{
-		Method: http.MethodPut,
-		URL:    uri,
-		Body:   cachetest.NewReader(value),
+		Method:        http.MethodPut,
+		URL:           uri,
+		Body:          cachetest.NewReader(value),
+		ContentLength: int64(len(value)),
 	})
 	if err != nil {
 		te.Fatalf("client error: %s", err)
@@ -117,7 +143,7 @@ func TestGetHit(t *testing.T) {
 }
 
 func testGetHit(t *testEnv, svc *service) {
-	key := "exists"
+	key := digest.SHA256.Sum([]byte("exists"))
 	want := []byte("existing value")
 	wantCmp := compress(want)
 
@@ -137,7 +163,7 @@ func TestGetMiss(t *testing.T) {
 }
 
 func testGetMiss(t *testEnv, svc *service) {
-	key := "missing"
+	key := digest.SHA256.Sum([]byte("missing"))
 	res := t.Get(svc, key)
 	if res.StatusCode != http.StatusNotFound {
 		t.Errorf("expected status code %d, got %d", http.StatusNotFound, res.StatusCode)
@@ -150,9 +176,8 @@ func TestPutNew(t *testing.T) {
 }
 
 func testPutNew(t *testEnv, svc *service) {
-	key := "new"
 	value := []byte("new value")
-	valueCmp := compress(value)
+	key := digest.SHA256.Sum(value)
 
 	// put value via the handler
 	res := t.Put(svc, key, value)
@@ -161,7 +186,7 @@ func testPutNew(t *testEnv, svc *service) {
 	}
 
 	// verify in cache
-	cachetest.AssertGet(t.T, svc.Cache, key, valueCmp)
+	assertStored(t.T, svc.Cache, key, value)
 }
 
 func TestPutExisting(t *testing.T) {
@@ -170,23 +195,810 @@ func TestPutExisting(t *testing.T) {
 }
 
 func testPutExisting(t *testEnv, svc *service) {
-	key := "new"
-	oldvalue := []byte("existing value")
-	oldvalueCmp := compress(oldvalue)
+	newvalue := []byte("new value")
+	key := digest.SHA256.Sum(newvalue)
 
 	// load value into cache
+	oldvalue := []byte("existing value")
+	oldvalueCmp := compress(oldvalue)
 	cachetest.AssertPut(t.T, svc.Cache, key, oldvalueCmp)
 
 	// put value via the handler
-	newvalue := []byte("new value")
-	newvalueCmp := compress(newvalue)
 	res := t.Put(svc, key, newvalue)
 	if res.StatusCode != http.StatusOK {
 		t.Fatalf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
 	}
 
 	// verify in cache
-	cachetest.AssertGet(t.T, svc.Cache, key, newvalueCmp)
+	assertStored(t.T, svc.Cache, key, newvalue)
+}
+
+func TestHeadHit(t *testing.T) {
+	te := Setup(t)
+	te.TestEach(testHeadHit)
+}
+
+func testHeadHit(t *testEnv, svc *service) {
+	value := []byte("existing value")
+	key := digest.SHA256.Sum(value)
+
+	// put value via the handler
+	res := t.Put(svc, key, value)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	res = t.Head(svc, key)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if res.ContentLength != int64(len(value)) {
+		t.Errorf("expected content length %d, got %d", len(value), res.ContentLength)
+	}
+}
+
+func TestHeadMiss(t *testing.T) {
+	te := Setup(t)
+	te.TestEach(testHeadMiss)
+}
+
+func testHeadMiss(t *testEnv, svc *service) {
+	key := digest.SHA256.Sum([]byte("missing"))
+	res := t.Head(svc, key)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestStreamLarge(t *testing.T) {
+	te := Setup(t)
+	te.TestEach(testStreamLarge)
+}
+
+func testStreamLarge(t *testEnv, svc *service) {
+	value := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(value)
+	key := digest.SHA256.Sum(value)
+
+	// put value via the handler
+	res := t.Put(svc, key, value)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	// retrieve it via the handler
+	have := t.GetValue(svc, key)
+	if !bytes.Equal(have, value) {
+		t.Errorf("expected %d byte value, got %d different bytes", len(value), len(have))
+	}
+}
+
+func TestPutMismatch(t *testing.T) {
+	te := Setup(t)
+	defer te.Teardown()
+
+	value := []byte("poisoned value")
+	key := digest.SHA256.Sum([]byte("expected value"))
+
+	// the CAS rejects a value which does not match its key
+	res := te.Put(te.CAS, key, value)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+	cachetest.AssertMiss(t, te.CAS.Cache, key)
+
+	// the AC stores any value
+	res = te.Put(te.AC, key, value)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	assertStored(t, te.AC.Cache, key, value)
+}
+
+func TestInvalidKey(t *testing.T) {
+	te := Setup(t)
+	defer te.Teardown()
+
+	keys := []string{
+		"invalid",
+		strings.ToUpper(digest.SHA256.Sum([]byte("value"))),
+		digest.SHA256.Sum([]byte("value"))[1:],
+	}
+	for _, svc := range te.Services() {
+		for _, key := range keys {
+			res := te.Put(svc, key, []byte("value"))
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status code %d for %s put of %q, got %d", http.StatusBadRequest, svc.Name, key, res.StatusCode)
+			}
+			cachetest.AssertMiss(t, svc.Cache, key)
+
+			res = te.Get(svc, key)
+			res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status code %d for %s get of %q, got %d", http.StatusBadRequest, svc.Name, key, res.StatusCode)
+			}
+
+			res = te.Head(svc, key)
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status code %d for %s head of %q, got %d", http.StatusBadRequest, svc.Name, key, res.StatusCode)
+			}
+		}
+	}
+}
+
+func TestPutDigestFunction(t *testing.T) {
+	t.Parallel()
+	cas := memory.New(1024*1024, 1024*1024)
+	handler := httphandler.New(cas, memory.New(1024*1024, 1024*1024), httphandler.Config{
+		Digest: digest.BLAKE3,
+	}, hatchet.Test(t))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	value := []byte("blake3 value")
+	for _, fn := range []*digest.Function{digest.SHA256, digest.BLAKE3} {
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/cas/%s", server.URL, fn.Sum(value)), bytes.NewReader(value))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("client error: %s", err)
+		}
+		res.Body.Close()
+
+		want := http.StatusBadRequest
+		if fn == digest.BLAKE3 {
+			want = http.StatusOK
+		}
+		if res.StatusCode != want {
+			t.Errorf("expected status code %d for %s key, got %d", want, fn, res.StatusCode)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	casCodec, err := codec.New(codec.Config{Encoding: codec.Zstd, Level: 9})
+	if err != nil {
+		t.Fatalf("failed to create codec: %s", err)
+	}
+	acCodec, err := codec.New(codec.Config{Encoding: codec.Identity})
+	if err != nil {
+		t.Fatalf("failed to create codec: %s", err)
+	}
+	cas := memory.New(64*1024*1024, 16*1024*1024)
+	ac := memory.New(64*1024*1024, 16*1024*1024)
+	handler := httphandler.New(cas, ac, httphandler.Config{
+		CASCodec: casCodec,
+		ACCodec:  acCodec,
+	}, hatchet.Test(t))
+	te := &testEnv{
+		T:      t,
+		CAS:    &service{Name: "cas", Cache: cas},
+		AC:     &service{Name: "ac", Cache: ac},
+		Client: &http.Client{},
+		Server: httptest.NewServer(handler),
+	}
+	defer te.Teardown()
+
+	value := bytes.Repeat([]byte("compressible value "), 1024)
+	key := digest.SHA256.Sum(value)
+	encodings := map[*service]string{
+		te.CAS: codec.Zstd,
+		te.AC:  codec.Identity,
+	}
+	for svc, want := range encodings {
+		res := te.Put(svc, key, value)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		info := cachetest.AssertStat(t, svc.Cache, key)
+		if info.ContentEncoding != want {
+			t.Errorf("expected %s encoding %q, got %q", svc.Name, want, info.ContentEncoding)
+		}
+		if have := te.GetValue(svc, key); !bytes.Equal(have, value) {
+			t.Errorf("expected %d byte value from %s, got %d bytes", len(value), svc.Name, len(have))
+		}
+	}
+
+	// objects stored with another encoding are still readable
+	old := []byte("old value")
+	oldKey := digest.SHA256.Sum(old)
+	cachetest.AssertPut(t, cas, oldKey, compress(old))
+	if have := te.GetValue(te.CAS, oldKey); !bytes.Equal(have, old) {
+		t.Errorf("expected value \"%s\", got \"%s\"", old, have)
+	}
+}
+
+// do sends a request for the key with the given headers.
+func (te *testEnv) do(method string, svc *service, key string, body []byte, header http.Header) *http.Response {
+	req, err := http.NewRequest(method, te.URL(svc, key), bytes.NewReader(body))
+	if err != nil {
+		te.Fatalf("request error: %s", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := te.Client.Do(req)
+	if err != nil {
+		te.Fatalf("client error: %s", err)
+	}
+	return res
+}
+
+func TestGetEncoded(t *testing.T) {
+	te := Setup(t)
+	defer te.Teardown()
+
+	value := bytes.Repeat([]byte("compressible value "), 1024)
+	key := digest.SHA256.Sum(value)
+	stored := compress(value)
+	cachetest.AssertPut(t, te.CAS.Cache, key, stored)
+
+	tests := []struct {
+		accept   string
+		encoding string
+	}{
+		{"gzip", "gzip"},
+		{"zstd, GZIP;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"zstd", ""},
+		{"identity", ""},
+	}
+	for _, test := range tests {
+		res := te.do(http.MethodGet, te.CAS, key, nil, http.Header{"Accept-Encoding": {test.accept}})
+		body := cachetest.ReadAll(t, res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if have := res.Header.Get("Content-Encoding"); have != test.encoding {
+			t.Errorf("accept %q: expected content encoding %q, got %q", test.accept, test.encoding, have)
+		}
+		want := value
+		if test.encoding != "" {
+			// the stored bytes are sent as-is
+			want = stored
+		}
+		if !bytes.Equal(body, want) {
+			t.Errorf("accept %q: expected %d byte body, got %d bytes", test.accept, len(want), len(body))
+		}
+	}
+}
+
+func TestPutEncoded(t *testing.T) {
+	t.Parallel()
+	value := bytes.Repeat([]byte("compressible value "), 1024)
+	key := digest.SHA256.Sum(value)
+	gzipped := compress(value)
+	enc, _ := zstd.NewWriter(nil)
+	zstded := enc.EncodeAll(value, nil)
+	corrupt := append([]byte{}, gzipped...)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"gzip", "gzip", gzipped, http.StatusOK},
+		{"zstd", "zstd", zstded, http.StatusOK},
+		{"mismatch", "gzip", compress([]byte("poisoned value")), http.StatusBadRequest},
+		{"corrupt", "gzip", corrupt, http.StatusBadRequest},
+		{"unsupported", "br", gzipped, http.StatusUnsupportedMediaType},
+	}
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			te := Setup(t)
+			defer te.Teardown()
+
+			res := te.do(http.MethodPut, te.CAS, key, test.body, http.Header{"Content-Encoding": {test.encoding}})
+			res.Body.Close()
+			if res.StatusCode != test.status {
+				t.Fatalf("expected status code %d, got %d", test.status, res.StatusCode)
+			}
+			if test.status != http.StatusOK {
+				cachetest.AssertMiss(t, te.CAS.Cache, key)
+				return
+			}
+
+			// the body is stored without compressing it again
+			info := cachetest.AssertStat(t, te.CAS.Cache, key)
+			if info.ContentEncoding != test.encoding {
+				t.Errorf("expected encoding %q, got %q", test.encoding, info.ContentEncoding)
+			}
+			if info.ContentLength != int64(len(value)) {
+				t.Errorf("expected content length %d, got %d", len(value), info.ContentLength)
+			}
+			cachetest.AssertGet(t, te.CAS.Cache, key, test.body)
+			assertStored(t, te.CAS.Cache, key, value)
+
+			// the decoded length is served to clients
+			res = te.Head(te.CAS, key)
+			res.Body.Close()
+			if have, want := res.Header.Get("Content-Length"), strconv.Itoa(len(value)); have != want {
+				t.Errorf("expected content length %s, got %s", want, have)
+			}
+			res = te.do(http.MethodGet, te.CAS, key, nil, http.Header{"Range": {"bytes=100-199"}})
+			body := cachetest.ReadAll(t, res.Body)
+			if res.StatusCode != http.StatusPartialContent {
+				t.Fatalf("expected status code %d, got %d", http.StatusPartialContent, res.StatusCode)
+			}
+			if have, want := res.Header.Get("Content-Range"), fmt.Sprintf("bytes 100-199/%d", len(value)); have != want {
+				t.Errorf("expected content range %q, got %q", want, have)
+			}
+			if !bytes.Equal(body, value[100:200]) {
+				t.Errorf("expected bytes 100 to 200")
+			}
+		})
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	compressible := bytes.Repeat([]byte("compressible value "), 1024)
+	incompressible := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+
+	values := map[string][]byte{
+		"compressed": compressible,
+		"identity":   incompressible,
+	}
+	for name := range values {
+		value := values[name]
+		t.Run(name, func(t *testing.T) {
+			te := Setup(t)
+			defer te.Teardown()
+			key := digest.SHA256.Sum(value)
+			te.Put(te.CAS, key, value).Body.Close()
+			size := len(value)
+
+			tests := []struct {
+				header string
+				start  int
+				end    int // exclusive
+			}{
+				{"bytes=0-4", 0, 5},
+				{"bytes=100-", 100, size},
+				{"bytes=-5", size - 5, size},
+				{"bytes=10-99999999", 10, size},
+				{"Bytes=7-7", 7, 8},
+			}
+			for _, test := range tests {
+				res := te.do(http.MethodGet, te.CAS, key, nil, http.Header{"Range": {test.header}})
+				body := cachetest.ReadAll(t, res.Body)
+				if res.StatusCode != http.StatusPartialContent {
+					t.Fatalf("range %q: expected status code %d, got %d", test.header, http.StatusPartialContent, res.StatusCode)
+				}
+				want := fmt.Sprintf("bytes %d-%d/%d", test.start, test.end-1, size)
+				if have := res.Header.Get("Content-Range"); have != want {
+					t.Errorf("range %q: expected content range %q, got %q", test.header, want, have)
+				}
+				if !bytes.Equal(body, value[test.start:test.end]) {
+					t.Errorf("range %q: expected bytes %d to %d", test.header, test.start, test.end)
+				}
+			}
+
+			// unsupported ranges are ignored
+			for _, header := range []string{"bytes=0-1,5-6", "items=0-4", "bytes=5-2", "bytes=x-"} {
+				res := te.do(http.MethodGet, te.CAS, key, nil, http.Header{"Range": {header}})
+				body := cachetest.ReadAll(t, res.Body)
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("range %q: expected status code %d, got %d", header, http.StatusOK, res.StatusCode)
+				}
+				if !bytes.Equal(body, value) {
+					t.Errorf("range %q: expected the whole object", header)
+				}
+			}
+
+			res := te.do(http.MethodGet, te.CAS, key, nil, http.Header{"Range": {fmt.Sprintf("bytes=%d-", size)}})
+			res.Body.Close()
+			if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+				t.Errorf("expected status code %d, got %d", http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+			}
+			if have, want := res.Header.Get("Content-Range"), fmt.Sprintf("bytes */%d", size); have != want {
+				t.Errorf("expected content range %q, got %q", want, have)
+			}
+		})
+	}
+}
+
+func TestGetRangeMiss(t *testing.T) {
+	te := Setup(t)
+	defer te.Teardown()
+
+	key := digest.SHA256.Sum([]byte("missing"))
+	res := te.do(http.MethodGet, te.CAS, key, nil, http.Header{"Range": {"bytes=0-4"}})
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	te := Setup(t)
+	defer te.Teardown()
+
+	value := []byte("example cache value")
+	key := digest.SHA256.Sum(value)
+	te.Put(te.CAS, key, value).Body.Close()
+	te.Put(te.AC, key, value).Body.Close()
+
+	res := te.do(http.MethodGet, te.CAS, key, nil, http.Header{"Range": {"bytes=0-6"}})
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	if etag != `"`+key+`"` {
+		t.Errorf("expected entity tag of the key, got %q", etag)
+	}
+	modified := res.Header.Get("Last-Modified")
+	if modified == "" {
+		t.Fatal("expected last modified")
+	}
+	old := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		svc     *service
+		ifRange string
+		status  int
+	}{
+		{te.CAS, etag, http.StatusPartialContent},
+		{te.CAS, `"other"`, http.StatusOK},
+		{te.CAS, "W/" + etag, http.StatusOK},
+		{te.CAS, modified, http.StatusPartialContent},
+		{te.CAS, old, http.StatusOK},
+		{te.AC, etag, http.StatusOK},
+		{te.AC, modified, http.StatusPartialContent},
+	}
+	for _, test := range tests {
+		res := te.do(http.MethodGet, test.svc, key, nil, http.Header{
+			"Range":    {"bytes=0-6"},
+			"If-Range": {test.ifRange},
+		})
+		body := cachetest.ReadAll(t, res.Body)
+		if res.StatusCode != test.status {
+			t.Errorf("%s if-range %q: expected status code %d, got %d", test.svc.Name, test.ifRange, test.status, res.StatusCode)
+			continue
+		}
+		want := value
+		if test.status == http.StatusPartialContent {
+			want = value[:7]
+		}
+		if !bytes.Equal(body, want) {
+			t.Errorf("%s if-range %q: expected value \"%s\", got \"%s\"", test.svc.Name, test.ifRange, want, body)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	handler := httphandler.New(memory.New(1024*1024, 1024*1024), memory.New(1024*1024, 1024*1024), httphandler.Config{
+		PipelineHeader: "X-Pipeline",
+	}, hatchet.Test(t))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	value := []byte("metrics value")
+	key := digest.SHA256.Sum(value)
+	do := func(method, key string, body []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s/cas/%s", server.URL, key), bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("X-Pipeline", "metrics-test")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("client error: %s", err)
+		}
+		res.Body.Close()
+	}
+	do(http.MethodPut, key, value)
+	do(http.MethodGet, key, nil)
+	do(http.MethodGet, key, nil)
+	do(http.MethodGet, digest.SHA256.Empty(), nil)
+
+	// metrics of other tests use a different pipeline
+	want := map[string]float64{
+		"PUT/stored": 1,
+		"GET/hit":    2,
+		"GET/miss":   1,
+	}
+	have := map[string]float64{}
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "hydroponics_http_requests_total" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["pipeline"] == "metrics-test" {
+				have[labels["method"]+"/"+labels["result"]] = metric.Counter.GetValue()
+			}
+		}
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("expected requests %v, got %v", want, have)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	t.Parallel()
+	handler := httphandler.New(memory.New(1024*1024, 1024*1024), memory.New(1024*1024, 1024*1024), httphandler.Config{
+		PipelineHeader: "X-Pipeline",
+	}, hatchet.Test(t))
+	tokens := auth.NewTokens(map[string]string{
+		"trusted":    "trusted-token",
+		"fork":       "fork-token",
+		"cas-writer": "cas-writer-token",
+		"stranger":   "stranger-token",
+	})
+	roles := auth.NewRoles(map[string]auth.Permission{
+		"trusted":    auth.All,
+		"fork":       auth.Read,
+		"cas-writer": auth.Read | auth.WriteCAS,
+	}, auth.None)
+	server := httptest.NewServer(auth.Handler(handler, []auth.Authenticator{tokens}, roles, hatchet.Test(t)))
+	defer server.Close()
+
+	value := []byte("permissions value")
+	key := digest.SHA256.Sum(value)
+	do := func(token, method, namespace string, body []byte) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s/%s/%s", server.URL, namespace, key), bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Pipeline", "permissions-test")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("client error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	tests := []struct {
+		token     string
+		method    string
+		namespace string
+		code      int
+	}{
+		{"trusted-token", http.MethodPut, "cas", http.StatusOK},
+		{"trusted-token", http.MethodPut, "ac", http.StatusOK},
+		{"fork-token", http.MethodGet, "cas", http.StatusOK},
+		{"fork-token", http.MethodHead, "ac", http.StatusOK},
+		{"fork-token", http.MethodPut, "cas", http.StatusForbidden},
+		{"fork-token", http.MethodPut, "ac", http.StatusForbidden},
+		{"cas-writer-token", http.MethodPut, "cas", http.StatusOK},
+		{"cas-writer-token", http.MethodGet, "ac", http.StatusOK},
+		{"cas-writer-token", http.MethodPut, "ac", http.StatusForbidden},
+		{"stranger-token", http.MethodGet, "cas", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if code := do(test.token, test.method, test.namespace, value); code != test.code {
+			t.Errorf("expected status code %d for %s %s with %s, got %d", test.code, test.method, test.namespace, test.token, code)
+		}
+	}
+
+	var denied float64
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "hydroponics_http_requests_total" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["pipeline"] == "permissions-test" && labels["result"] == "denied" {
+				denied += metric.Counter.GetValue()
+			}
+		}
+	}
+	if denied != 4 {
+		t.Errorf("expected 4 denied requests, got %v", denied)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	t.Parallel()
+	newCache := func() cache.Cache { return memory.New(1024*1024, 1024*1024) }
+	handler := httphandler.New(newCache(), newCache(), httphandler.Config{
+		Instances: []httphandler.Instance{
+			{Name: "repo-a", CAS: newCache(), AC: newCache()},
+			{Name: "team/repo-b", CAS: newCache(), AC: newCache()},
+		},
+	}, hatchet.Test(t))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	key := digest.SHA256.Sum([]byte("instance value"))
+	do := func(method, path string, body []byte) int {
+		req, err := http.NewRequest(method, server.URL+path+key, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("client error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := do(http.MethodPut, "/repo-a/ac/", []byte("value")); code != http.StatusOK {
+		t.Fatalf("expected status code %d for put, got %d", http.StatusOK, code)
+	}
+	tests := map[string]int{
+		"/repo-a/ac/":      http.StatusOK,
+		"/ac/":             http.StatusNotFound,
+		"/repo-a/cas/":     http.StatusNotFound,
+		"/team/repo-b/ac/": http.StatusNotFound,
+		"/repo-b/ac/":      http.StatusForbidden,
+		"/repo-c/ac/":      http.StatusForbidden,
+		"/repo-a/other/":   http.StatusNotFound,
+	}
+	for path, want := range tests {
+		if have := do(http.MethodGet, path, nil); have != want {
+			t.Errorf("expected status code %d for %s, got %d", want, path, have)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	te := Setup(t)
+	defer te.Teardown()
+
+	value := []byte("traced value")
+	key := digest.SHA256.Sum(value)
+	cachetest.AssertPut(t, te.CAS.Cache, key, compress(value))
+
+	// the request continues the client's trace
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodGet, te.URL(te.CAS, key), nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.Header.Set("Traceparent", fmt.Sprintf("00-%s-00f067aa0ba902b7-01", traceID))
+	res, err := te.Client.Do(req)
+	if err != nil {
+		t.Fatalf("client error: %s", err)
+	}
+	cachetest.ReadAll(t, res.Body)
+
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			names[span.Name()] = true
+		}
+	}
+	for _, name := range []string{"cache GET", "stream response"} {
+		if !names[name] {
+			t.Errorf("expected span %q in trace, got %v", name, names)
+		}
+	}
+}
+
+// blockingCache blocks each operation until its context is done. The context
+// error is sent on done once the operation has been cancelled.
+type blockingCache struct {
+	started chan struct{}
+	done    chan error
+}
+
+func newBlockingCache() *blockingCache {
+	return &blockingCache{
+		started: make(chan struct{}, 1),
+		done:    make(chan error, 1),
+	}
+}
+
+func (c *blockingCache) block(ctx context.Context) error {
+	c.started <- struct{}{}
+	<-ctx.Done()
+	c.done <- ctx.Err()
+	return ctx.Err()
+}
+
+func (c *blockingCache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, c.block(ctx)
+}
+
+func (c *blockingCache) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	return nil, c.block(ctx)
+}
+
+func (c *blockingCache) Put(ctx context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
+	return c.block(ctx)
+}
+
+func TestCancel(t *testing.T) {
+	t.Parallel()
+	methods := []string{http.MethodHead, http.MethodGet, http.MethodPut}
+	for i := range methods {
+		method := methods[i]
+		t.Run(method, func(t *testing.T) {
+			t.Parallel()
+			backend := newBlockingCache()
+			handler := httphandler.New(backend, backend, httphandler.Config{}, hatchet.Test(t))
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// the server only notices the client going away once the request
+			// body has been read
+			var body io.Reader
+			if method == http.MethodPut {
+				body = bytes.NewReader([]byte("value"))
+			}
+			req, err := http.NewRequest(method, fmt.Sprintf("%s/ac/%s", server.URL, digest.SHA256.Sum([]byte("key"))), body)
+			if err != nil {
+				t.Fatalf("request error: %s", err)
+			}
+			go http.DefaultClient.Do(req.WithContext(ctx))
+
+			// abort the request once it reaches the backend
+			<-backend.started
+			cancel()
+
+			select {
+			case err := <-backend.done:
+				if err != context.Canceled {
+					t.Errorf("expected \"%s\", got \"%s\"", context.Canceled, err)
+				}
+			case <-time.After(15 * time.Second):
+				t.Error("cancellation did not reach the backend")
+			}
+		})
+	}
+}
+
+func TestCancelTimeout(t *testing.T) {
+	t.Parallel()
+	backend := newBlockingCache()
+	handler := httphandler.New(backend, backend, httphandler.Config{
+		Timeout: 10 * time.Millisecond,
+	}, hatchet.Test(t))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// the timeout applies while the client waits
+	res, err := http.Get(fmt.Sprintf("%s/ac/%s", server.URL, digest.SHA256.Sum([]byte("key"))))
+	if err != nil {
+		t.Fatalf("client error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status code %d, got %d", http.StatusInternalServerError, res.StatusCode)
+	}
+	if err := <-backend.done; err != context.DeadlineExceeded {
+		t.Errorf("expected \"%s\", got \"%s\"", context.DeadlineExceeded, err)
+	}
+}
+
+// assertStored checks that the object decodes to the wanted value.
+func assertStored(t *testing.T, c cache.Cache, key string, want []byte) {
+	rdr, err := codec.Get(context.Background(), c, key)
+	if err != nil {
+		t.Fatalf("failed to get value: %s", err)
+	}
+	if have := cachetest.ReadAll(t, rdr); !bytes.Equal(have, want) {
+		t.Errorf("expected value \"%s\", got \"%s\"", want, have)
+	}
 }
 
 func compress(value []byte) []byte {
@@ -0,0 +1,61 @@
+package httphandler
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results of a cache request.
+const (
+	resultHit      = "hit"
+	resultMiss     = "miss"
+	resultStored   = "stored"
+	resultRejected = "rejected"
+	resultDenied   = "denied"
+	resultError    = "error"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Cache requests by instance, cache namespace, method, pipeline, and result.",
+	}, []string{"instance", "namespace", "method", "pipeline", "result"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hydroponics",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of cache requests by cache namespace and method.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"namespace", "method"})
+
+	receivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "http",
+		Name:      "received_bytes_total",
+		Help:      "Decoded bytes received in PUT requests by cache namespace and pipeline.",
+	}, []string{"namespace", "pipeline"})
+
+	sentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "http",
+		Name:      "sent_bytes_total",
+		Help:      "Decoded bytes sent in GET responses by cache namespace and pipeline.",
+	}, []string{"namespace", "pipeline"})
+)
+
+// countReader counts the bytes read from a reader.
+type countReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
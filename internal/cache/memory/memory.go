@@ -5,70 +5,172 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/golang/groupcache/lru"
 	"github.com/zenreach/hydroponics/internal/cache"
 )
 
-// lruCache implements an in-memory LRU cache.
+// lruCache implements an in-memory LRU cache. It is safe for concurrent use.
 type lruCache struct {
-	lru *lru.Cache
+	maxSize       int64
+	maxObjectSize int64
+
+	mu   sync.Mutex
+	lru  *lru.Cache
+	size int64
 }
 
-// New returns a new in-memory LRU cache which will keep up to size items.
-func New(size int) cache.Cache {
-	return &lruCache{
-		lru: lru.New(size),
+// New returns a new in-memory LRU cache which will keep up to maxSize bytes.
+// Objects larger than maxObjectSize are not cached.
+func New(maxSize, maxObjectSize int64) cache.Cache {
+	if maxObjectSize > maxSize {
+		maxObjectSize = maxSize
+	}
+	c := &lruCache{
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		lru:           lru.New(0),
 	}
+	c.lru.OnEvicted = c.evicted
+	return c
+}
+
+// entry is a value stored in the LRU.
+type entry struct {
+	data []byte
+	info cache.Info
 }
 
 func (c *lruCache) Get(_ context.Context, key string) (io.ReadCloser, error) {
-	data, err := c.getBytes(key)
+	ent, err := c.getEntry(key)
 	if err != nil {
 		return nil, err
 	}
-	return &nopCloser{bytes.NewBuffer(data)}, nil
+	return &object{
+		Reader: bytes.NewReader(ent.data),
+		meta:   ent.info.Metadata,
+	}, nil
 }
 
-func (c *lruCache) Put(_ context.Context, key string, rdr io.Reader) error {
+func (c *lruCache) GetRange(_ context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	ent, err := c.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	data := ent.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return &object{
+		Reader: bytes.NewReader(data),
+		meta:   ent.info.Metadata,
+	}, nil
+}
+
+func (c *lruCache) MaxObjectSize() int64 {
+	return c.maxObjectSize
+}
+
+func (c *lruCache) Stat(_ context.Context, key string) (*cache.Info, error) {
+	ent, err := c.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	info := ent.info
+	return &info, nil
+}
+
+func (c *lruCache) Put(_ context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
 	buf := &bytes.Buffer{}
-	_, err := io.Copy(buf, rdr)
+	n, err := io.Copy(buf, io.LimitReader(rdr, c.maxObjectSize+1))
 	if err != nil {
 		return err
 	}
-	return c.putBytes(key, buf.Bytes())
+	if n > c.maxObjectSize {
+		// too large to cache; forget the replaced object so that it is not
+		// served in place of the new one and drain the reader so the writer is
+		// not blocked
+		c.removeEntry(key)
+		_, err = io.Copy(ioutil.Discard, rdr)
+		return err
+	}
+	return c.putEntry(key, &entry{
+		data: buf.Bytes(),
+		info: cache.Info{
+			Metadata:     meta,
+			Size:         n,
+			LastModified: time.Now(),
+		},
+	})
 }
 
-func (c *lruCache) getBytes(key string) ([]byte, error) {
+func (c *lruCache) getEntry(key string) (*entry, error) {
 	if c.lru == nil {
 		// defensive sanity check; cache was not created with New
 		panic("cache lru not initialized")
 	}
+	c.mu.Lock()
 	iface, ok := c.lru.Get(key)
+	c.mu.Unlock()
 	if !ok {
 		return nil, cache.ErrCacheMiss
 	}
-	data, ok := iface.([]byte)
+	ent, ok := iface.(*entry)
 	if !ok {
 		// defensive sanity check; should not happen if all is implemented properly
 		panic(fmt.Sprintf("lru key %s contains invalid type", key))
 	}
-	return data, nil
+	return ent, nil
 }
 
-func (c *lruCache) putBytes(key string, data []byte) error {
+func (c *lruCache) putEntry(key string, ent *entry) error {
 	if c.lru == nil {
 		// defensive sanity check; cache was not created with New
 		panic("cache lru not initialized")
 	}
-	c.lru.Add(key, data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// remove the existing entry so its size is released
+	c.lru.Remove(key)
+	c.lru.Add(key, ent)
+	c.size += ent.info.Size
+	for c.size > c.maxSize {
+		c.lru.RemoveOldest()
+	}
 	return nil
 }
 
-type nopCloser struct {
+func (c *lruCache) removeEntry(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+}
+
+// evicted is called by the LRU with the lock held when an entry is removed.
+func (c *lruCache) evicted(_ lru.Key, value interface{}) {
+	if ent, ok := value.(*entry); ok {
+		c.size -= ent.info.Size
+	}
+}
+
+// object is a reader of a cached object.
+type object struct {
 	io.Reader
+	meta cache.Metadata
+}
+
+func (o *object) Metadata() cache.Metadata {
+	return o.meta
 }
 
-func (nopCloser) Close() error {
+func (*object) Close() error {
 	return nil
 }
@@ -9,13 +9,13 @@ import (
 )
 
 func TestCommon(t *testing.T) {
-	cachetest.Test(t, func() cache.Cache {
-		return memory.New(100)
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		return memory.New(1024*1024, 1024)
 	})
 }
 
 func TestExpire(t *testing.T) {
-	c := memory.New(2)
+	c := memory.New(12, 6)
 
 	// add values
 	cachetest.AssertPut(t, c, "key1", []byte("value1"))
@@ -32,3 +32,35 @@ func TestExpire(t *testing.T) {
 	cachetest.AssertMiss(t, c, "key2")
 	cachetest.AssertGet(t, c, "key3", []byte("value3"))
 }
+
+func TestReplace(t *testing.T) {
+	c := memory.New(12, 12)
+
+	// replacing a value releases the space used by the old value
+	cachetest.AssertPut(t, c, "key1", []byte("value1"))
+	cachetest.AssertPut(t, c, "key1", []byte("value1"))
+	cachetest.AssertPut(t, c, "key2", []byte("value2"))
+
+	cachetest.AssertGet(t, c, "key1", []byte("value1"))
+	cachetest.AssertGet(t, c, "key2", []byte("value2"))
+}
+
+func TestOversize(t *testing.T) {
+	c := memory.New(12, 6)
+
+	// an object larger than the max object size is not cached
+	cachetest.AssertPut(t, c, "key1", []byte("value1"))
+	cachetest.AssertPut(t, c, "key2", []byte("large value"))
+
+	cachetest.AssertGet(t, c, "key1", []byte("value1"))
+	cachetest.AssertMiss(t, c, "key2")
+}
+
+func TestOversizeReplace(t *testing.T) {
+	c := memory.New(12, 6)
+
+	// replacing an object with one too large to cache removes the old object
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+	cachetest.AssertPut(t, c, "key", []byte("large value"))
+	cachetest.AssertMiss(t, c, "key")
+}
@@ -0,0 +1,21 @@
+package negative
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results of a lookup recorded in metrics.
+const (
+	// resultHit is a remembered miss served without the wrapped cache.
+	resultHit = "hit"
+	// resultMiss is a lookup passed to the wrapped cache.
+	resultMiss = "miss"
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "hydroponics",
+	Subsystem: "negative_cache",
+	Name:      "requests_total",
+	Help:      "Negative cache lookups by result. A hit is a remembered miss.",
+}, []string{"result"})
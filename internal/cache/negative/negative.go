@@ -0,0 +1,155 @@
+package negative
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/zenreach/hydroponics/internal/cache"
+)
+
+// DefaultMaxEntries is the default number of misses remembered.
+const DefaultMaxEntries = 100000
+
+// Config configures a negative cache.
+type Config struct {
+	// TTL is how long a miss is remembered.
+	TTL time.Duration
+
+	// MaxEntries is the maximum number of misses remembered. The least
+	// recently used are forgotten first. Defaults to DefaultMaxEntries.
+	MaxEntries int
+}
+
+// Cache wraps a cache and remembers the keys which recently missed. Gets and
+// stats of a remembered key miss without asking the wrapped cache until the
+// TTL expires. A Put of the key forgets the miss immediately. Objects put
+// into the wrapped cache by other processes are not seen until the TTL
+// expires.
+type Cache struct {
+	cache cache.Cache
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu  sync.Mutex
+	lru *lru.Cache
+}
+
+// New returns a negative cache in front of c.
+func New(c cache.Cache, cfg Config) *Cache {
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Cache{
+		cache: c,
+		ttl:   cfg.TTL,
+		now:   time.Now,
+		lru:   lru.New(maxEntries),
+	}
+}
+
+// entry is a miss of a key. The expiration is zero while the lookup which
+// may miss is in progress.
+type entry struct {
+	expires time.Time
+}
+
+func (c *Cache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if c.missed(key) {
+		return nil, cache.ErrCacheMiss
+	}
+	lookup := c.begin(key)
+	rdr, err := c.cache.Get(ctx, key)
+	c.end(key, lookup, err)
+	return rdr, err
+}
+
+func (c *Cache) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if c.missed(key) {
+		return nil, cache.ErrCacheMiss
+	}
+	lookup := c.begin(key)
+	rdr, err := cache.GetRange(ctx, c.cache, key, offset, length)
+	c.end(key, lookup, err)
+	return rdr, err
+}
+
+func (c *Cache) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	if c.missed(key) {
+		return nil, cache.ErrCacheMiss
+	}
+	lookup := c.begin(key)
+	info, err := c.cache.Stat(ctx, key)
+	c.end(key, lookup, err)
+	return info, err
+}
+
+// Put stores the object in the wrapped cache. The key's miss is forgotten
+// before and after the object is stored so that a lookup which ran during the
+// put does not remember a miss.
+func (c *Cache) Put(ctx context.Context, key string, data io.Reader, meta cache.Metadata) error {
+	c.forget(key)
+	err := c.cache.Put(ctx, key, data, meta)
+	c.forget(key)
+	return err
+}
+
+// missed returns true if the key recently missed.
+func (c *Cache) missed(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.lru.Get(key)
+	if !ok {
+		requestsTotal.WithLabelValues(resultMiss).Inc()
+		return false
+	}
+	ent := value.(*entry)
+	if ent.expires.IsZero() {
+		requestsTotal.WithLabelValues(resultMiss).Inc()
+		return false
+	}
+	if !c.now().Before(ent.expires) {
+		c.lru.Remove(key)
+		requestsTotal.WithLabelValues(resultMiss).Inc()
+		return false
+	}
+	requestsTotal.WithLabelValues(resultHit).Inc()
+	return true
+}
+
+// begin starts a lookup of the key in the wrapped cache. The returned entry
+// identifies the lookup. It is replaced by a later lookup and removed by a
+// put of the key.
+func (c *Cache) begin(key string) *entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent := &entry{}
+	c.lru.Add(key, ent)
+	return ent
+}
+
+// end finishes a lookup. A miss is remembered if the lookup was not replaced
+// or removed while it ran. The lookup is removed otherwise.
+func (c *Cache) end(key string, lookup *entry, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.lru.Get(key)
+	if !ok || value.(*entry) != lookup {
+		return
+	}
+	if err == cache.ErrCacheMiss {
+		lookup.expires = c.now().Add(c.ttl)
+	} else {
+		c.lru.Remove(key)
+	}
+}
+
+// forget removes any miss of the key.
+func (c *Cache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+}
@@ -0,0 +1,141 @@
+package negative_test
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/memory"
+	"github.com/zenreach/hydroponics/internal/cache/negative"
+)
+
+// countingCache counts the stats of a memory cache. A stat waits for the gate
+// after looking up the object if the gate is set. Stats fail as unavailable
+// while unavailable is set.
+type countingCache struct {
+	cache.Cache
+	gate        chan struct{}
+	stats       int32
+	unavailable bool
+}
+
+func newCountingCache() *countingCache {
+	return &countingCache{
+		Cache: memory.New(4*1024*1024, 4*1024*1024),
+	}
+}
+
+func (c *countingCache) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	atomic.AddInt32(&c.stats, 1)
+	if c.unavailable {
+		return nil, cache.ErrUnavailable
+	}
+	info, err := c.Cache.Stat(ctx, key)
+	if c.gate != nil {
+		<-c.gate
+	}
+	return info, err
+}
+
+// assertStats checks the number of stats which reached the backend.
+func assertStats(t *testing.T, backend *countingCache, want int32) {
+	t.Helper()
+	if have := atomic.LoadInt32(&backend.stats); have != want {
+		t.Errorf("expected %d backend stats, got %d", want, have)
+	}
+}
+
+func TestCommon(t *testing.T) {
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		return negative.New(newCountingCache(), negative.Config{TTL: time.Minute})
+	})
+}
+
+func TestMiss(t *testing.T) {
+	backend := newCountingCache()
+	c := negative.New(backend, negative.Config{TTL: 100 * time.Millisecond})
+
+	cachetest.AssertContains(t, c, "key", false)
+	cachetest.AssertContains(t, c, "key", false)
+	assertStats(t, backend, 1)
+
+	// gets share the remembered misses
+	cachetest.AssertMiss(t, c, "key")
+
+	// the miss is forgotten once the ttl expires
+	time.Sleep(150 * time.Millisecond)
+	cachetest.AssertContains(t, c, "key", false)
+	assertStats(t, backend, 2)
+}
+
+func TestUnavailable(t *testing.T) {
+	backend := newCountingCache()
+	backend.unavailable = true
+	c := negative.New(backend, negative.Config{TTL: time.Minute})
+
+	// misses of an unavailable cache are not remembered
+	cachetest.AssertContains(t, c, "key", false)
+	cachetest.AssertContains(t, c, "key", false)
+	assertStats(t, backend, 2)
+
+	// the object is found once the cache is available
+	cachetest.AssertPut(t, backend.Cache, "key", []byte("value"))
+	backend.unavailable = false
+	cachetest.AssertContains(t, c, "key", true)
+}
+
+func TestPutForgetsMiss(t *testing.T) {
+	backend := newCountingCache()
+	c := negative.New(backend, negative.Config{TTL: time.Minute})
+
+	cachetest.AssertContains(t, c, "key", false)
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+	cachetest.AssertGet(t, c, "key", []byte("value"))
+	cachetest.AssertContains(t, c, "key", true)
+}
+
+func TestPutDuringLookup(t *testing.T) {
+	backend := newCountingCache()
+	backend.gate = make(chan struct{})
+	c := negative.New(backend, negative.Config{TTL: time.Minute})
+
+	// the lookup misses before the put but returns after it
+	done := make(chan bool)
+	go func() {
+		found, _ := cache.Contains(context.Background(), c, "key")
+		done <- found
+	}()
+	for atomic.LoadInt32(&backend.stats) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	err := c.Put(context.Background(), "key", bytes.NewReader([]byte("value")), cache.Metadata{ContentLength: -1})
+	if err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+	close(backend.gate)
+	if <-done {
+		t.Fatal("expected lookup to miss")
+	}
+
+	// the miss is not remembered
+	cachetest.AssertContains(t, c, "key", true)
+}
+
+func TestMaxEntries(t *testing.T) {
+	backend := newCountingCache()
+	c := negative.New(backend, negative.Config{TTL: time.Minute, MaxEntries: 1})
+
+	cachetest.AssertContains(t, c, "first", false)
+	cachetest.AssertContains(t, c, "second", false)
+	assertStats(t, backend, 2)
+
+	// the first miss was forgotten to remember the second
+	cachetest.AssertContains(t, c, "second", false)
+	assertStats(t, backend, 2)
+	cachetest.AssertContains(t, c, "first", false)
+	assertStats(t, backend, 3)
+}
@@ -0,0 +1,91 @@
+package reapi
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetActionResult returns the cached result of an action.
+func (s *Server) GetActionResult(ctx context.Context, req *pb.GetActionResultRequest) (*pb.ActionResult, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.ReadAC); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(req.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkDigest(req.ActionDigest); err != nil {
+		return nil, err
+	}
+	key := req.ActionDigest.Hash
+
+	rdr, err := codec.Get(ctx, inst.AC, key)
+	if cache.IsMiss(err) {
+		s.logDebug(key, "cache miss")
+		return nil, cacheError(err)
+	} else if err != nil {
+		s.logError(err, key, "cache error")
+		return nil, cacheError(err)
+	}
+	defer rdr.Close()
+
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		s.logError(err, key, "i/o error")
+		return nil, cacheError(err)
+	}
+	result := &pb.ActionResult{}
+	if err := proto.Unmarshal(data, result); err != nil {
+		s.logError(err, key, "invalid action result")
+		return nil, status.Errorf(codes.Internal, "invalid action result %s: %s", key, err)
+	}
+	s.logDebug(key, "cache hit")
+	return result, nil
+}
+
+// UpdateActionResult stores the result of an action.
+func (s *Server) UpdateActionResult(ctx context.Context, req *pb.UpdateActionResultRequest) (*pb.ActionResult, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.WriteAC); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(req.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkDigest(req.ActionDigest); err != nil {
+		return nil, err
+	}
+	if req.ActionResult == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing action result")
+	}
+	key := req.ActionDigest.Hash
+
+	data, err := proto.Marshal(req.ActionResult)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid action result: %s", err)
+	}
+	err = s.acCodec.Put(ctx, inst.AC, key, bytes.NewReader(data), int64(len(data)), s.bufferSize)
+	if err != nil {
+		s.logError(err, key, "cache error")
+		return nil, cacheError(err)
+	}
+	s.logDebug(key, "cache put")
+	return req.ActionResult, nil
+}
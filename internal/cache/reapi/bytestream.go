@@ -0,0 +1,257 @@
+package reapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Read streams a blob from the CAS. The read offset and limit refer to the
+// uncompressed blob, so a compressed read sends the compressed contents of the
+// requested part of the blob.
+func (s *Server) Read(req *bs.ReadRequest, stream bs.ByteStream_ReadServer) error {
+	ctx, cancel := s.withTimeout(stream.Context())
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.ReadCAS); err != nil {
+		return err
+	}
+
+	res, err := s.parseResource(req.ResourceName, false)
+	if err != nil {
+		return err
+	}
+	inst, err := s.instance(res.instance)
+	if err != nil {
+		return err
+	}
+	if req.ReadOffset < 0 || req.ReadLimit < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid read offset %d or limit %d", req.ReadOffset, req.ReadLimit)
+	}
+
+	rdr, err := s.openBlob(ctx, inst.CAS, res.digest)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(ioutil.Discard, rdr, req.ReadOffset)
+	if err == io.EOF {
+		rdr.Close()
+		return status.Errorf(codes.OutOfRange, "read offset %d exceeds blob size", req.ReadOffset)
+	} else if err != nil {
+		rdr.Close()
+		s.logError(err, res.digest.Hash, "i/o error")
+		return cacheError(err)
+	}
+
+	if req.ReadLimit > 0 {
+		rdr = cache.LimitReadCloser(rdr, req.ReadLimit)
+	}
+	if res.compressor == compressorZstd {
+		rdr = newZstdReader(rdr)
+	}
+	defer rdr.Close()
+
+	buf := make([]byte, s.bufferSize)
+	for {
+		n, err := io.ReadFull(rdr, buf)
+		if n > 0 {
+			sendErr := stream.Send(&bs.ReadResponse{
+				Data: buf[:n],
+			})
+			if sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			s.logError(err, res.digest.Hash, "i/o error")
+			return cacheError(err)
+		}
+	}
+	s.logDebug(res.digest.Hash, "cache hit")
+	return nil
+}
+
+// openBlob returns a reader of the decompressed contents of a blob in the
+// CAS.
+func (s *Server) openBlob(ctx context.Context, cas cache.Cache, digest *pb.Digest) (io.ReadCloser, error) {
+	if s.isEmpty(digest) {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	rdr, err := codec.Get(ctx, cas, digest.Hash)
+	if cache.IsMiss(err) {
+		s.logDebug(digest.Hash, "cache miss")
+		return nil, cacheError(err)
+	} else if err != nil {
+		s.logError(err, digest.Hash, "cache error")
+		return nil, cacheError(err)
+	}
+	return rdr, nil
+}
+
+// Write streams a blob into the CAS. The data is spooled until the client
+// finishes the write so that an interrupted upload may be resumed from its
+// committed size. The blob is verified against its digest before it is
+// stored.
+func (s *Server) Write(stream bs.ByteStream_WriteServer) error {
+	ctx, cancel := s.withTimeout(stream.Context())
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.WriteCAS); err != nil {
+		return err
+	}
+
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "empty write")
+	} else if err != nil {
+		return err
+	}
+	name := req.ResourceName
+	res, err := s.parseResource(name, true)
+	if err != nil {
+		return err
+	}
+	inst, err := s.instance(res.instance)
+	if err != nil {
+		return err
+	}
+
+	// skip the upload if the blob already exists
+	exists, err := s.blobExists(ctx, inst.CAS, res.digest)
+	if err != nil {
+		return err
+	} else if exists {
+		s.uploads.remove(name)
+		return stream.SendAndClose(&bs.WriteResponse{
+			CommittedSize: existingSize(res),
+		})
+	}
+
+	up, err := s.uploads.open(name)
+	if err != nil {
+		s.logError(err, res.digest.Hash, "upload error")
+		return status.Errorf(codes.Internal, "failed to start upload: %s", err)
+	}
+	for {
+		if req.ResourceName != "" && req.ResourceName != name {
+			return status.Errorf(codes.InvalidArgument, "resource %q does not match %q", req.ResourceName, name)
+		}
+		committed, err := up.write(req.WriteOffset, req.Data)
+		if err != nil {
+			return err
+		}
+		if req.FinishWrite {
+			err = s.commitUpload(ctx, inst.CAS, res, up)
+			s.uploads.remove(name)
+			if err != nil {
+				return err
+			}
+			return stream.SendAndClose(&bs.WriteResponse{
+				CommittedSize: committed,
+			})
+		}
+
+		req, err = stream.Recv()
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "write ended before it was finished")
+		} else if err != nil {
+			// keep the upload so that it may be resumed
+			return err
+		}
+	}
+}
+
+// commitUpload verifies the spooled upload data and stores it in the CAS.
+func (s *Server) commitUpload(ctx context.Context, cas cache.Cache, res *resource, up *upload) error {
+	var rdr io.Reader = up.reader()
+	if res.compressor == compressorZstd {
+		dec, err := newZstdDecoder(rdr)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to decompress upload: %s", err)
+		}
+		defer dec.Close()
+		rdr = dec
+	}
+
+	ver := s.digest.NewVerifier(rdr, res.digest.Hash, res.digest.SizeBytes)
+	err := s.casCodec.Put(ctx, cas, res.digest.Hash, ver, res.digest.SizeBytes, s.bufferSize)
+	if ver.Mismatch() {
+		s.logDebug(res.digest.Hash, "digest mismatch")
+		return status.Errorf(codes.InvalidArgument, "upload does not match digest %s/%d", res.digest.Hash, res.digest.SizeBytes)
+	} else if err != nil {
+		s.logError(err, res.digest.Hash, "cache error")
+		return cacheError(err)
+	}
+	s.logDebug(res.digest.Hash, "cache put")
+	return nil
+}
+
+// QueryWriteStatus returns the committed size of an upload. Uploads of blobs
+// which exist in the CAS are reported as complete.
+func (s *Server) QueryWriteStatus(ctx context.Context, req *bs.QueryWriteStatusRequest) (*bs.QueryWriteStatusResponse, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.WriteCAS); err != nil {
+		return nil, err
+	}
+
+	res, err := s.parseResource(req.ResourceName, true)
+	if err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(res.instance)
+	if err != nil {
+		return nil, err
+	}
+	if up := s.uploads.get(req.ResourceName); up != nil {
+		return &bs.QueryWriteStatusResponse{
+			CommittedSize: up.size(),
+		}, nil
+	}
+
+	exists, err := s.blobExists(ctx, inst.CAS, res.digest)
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, status.Errorf(codes.NotFound, "upload %q not found", req.ResourceName)
+	}
+	return &bs.QueryWriteStatusResponse{
+		CommittedSize: existingSize(res),
+		Complete:      true,
+	}, nil
+}
+
+// blobExists returns true if the blob is in the CAS.
+func (s *Server) blobExists(ctx context.Context, cas cache.Cache, digest *pb.Digest) (bool, error) {
+	if s.isEmpty(digest) {
+		return true, nil
+	}
+	exists, err := cache.Contains(ctx, cas, digest.Hash)
+	if err != nil {
+		s.logError(err, digest.Hash, "cache error")
+		return false, cacheError(err)
+	}
+	return exists, nil
+}
+
+// existingSize returns the committed size reported for an upload of a blob
+// which already exists. The compressed size of the blob is not known so -1 is
+// reported for compressed uploads.
+func existingSize(res *resource) int64 {
+	if res.compressor != "" {
+		return -1
+	}
+	return res.digest.SizeBytes
+}
@@ -0,0 +1,230 @@
+package reapi_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/zenreach/hydroponics/internal/cache/reapi"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func blobName(d *pb.Digest) string {
+	return fmt.Sprintf("instance/blobs/%s/%d", d.Hash, d.SizeBytes)
+}
+
+func uploadName(d *pb.Digest) string {
+	return fmt.Sprintf("instance/uploads/d5c8c9a4-1f8b-4b7e-9c3e-2a1f0b6d7e8f/blobs/%s/%d", d.Hash, d.SizeBytes)
+}
+
+func read(srv *reapi.Server, req *bs.ReadRequest) ([]byte, error) {
+	stream := &readStream{ctx: context.Background()}
+	err := srv.Read(req, stream)
+	return stream.data.Bytes(), err
+}
+
+func write(srv *reapi.Server, reqs ...*bs.WriteRequest) (*bs.WriteResponse, error) {
+	stream := &writeStream{
+		ctx:  context.Background(),
+		reqs: reqs,
+	}
+	err := srv.Write(stream)
+	return stream.res, err
+}
+
+func TestByteStreamWriteRead(t *testing.T) {
+	srv := setup(t)
+	data := []byte("bytestream blob")
+	d := digest(data)
+
+	res, err := write(srv, &bs.WriteRequest{
+		ResourceName: uploadName(d),
+		Data:         data[:5],
+	}, &bs.WriteRequest{
+		WriteOffset: 5,
+		Data:        data[5:],
+		FinishWrite: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to write blob: %s", err)
+	}
+	if res.CommittedSize != d.SizeBytes {
+		t.Errorf("expected committed size %d, got %d", d.SizeBytes, res.CommittedSize)
+	}
+
+	have, err := read(srv, &bs.ReadRequest{
+		ResourceName: blobName(d),
+		ReadOffset:   5,
+		ReadLimit:    6,
+	})
+	if err != nil {
+		t.Fatalf("failed to read blob: %s", err)
+	}
+	if want := data[5:11]; !bytes.Equal(have, want) {
+		t.Errorf("expected value \"%s\", got \"%s\"", want, have)
+	}
+}
+
+func TestByteStreamResume(t *testing.T) {
+	srv := setup(t)
+	data := []byte("resumable blob")
+	d := digest(data)
+	name := uploadName(d)
+
+	// the first stream is interrupted before the write is finished
+	_, err := write(srv, &bs.WriteRequest{
+		ResourceName: name,
+		Data:         data[:8],
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected status %s, got %s", codes.Unavailable, status.Code(err))
+	}
+
+	query, err := srv.QueryWriteStatus(context.Background(), &bs.QueryWriteStatusRequest{
+		ResourceName: name,
+	})
+	if err != nil {
+		t.Fatalf("failed to query write status: %s", err)
+	}
+	if query.CommittedSize != 8 || query.Complete {
+		t.Fatalf("expected incomplete upload of 8 bytes, got %+v", query)
+	}
+
+	_, err = write(srv, &bs.WriteRequest{
+		ResourceName: name,
+		WriteOffset:  query.CommittedSize,
+		Data:         data[query.CommittedSize:],
+		FinishWrite:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to resume write: %s", err)
+	}
+
+	query, err = srv.QueryWriteStatus(context.Background(), &bs.QueryWriteStatusRequest{
+		ResourceName: name,
+	})
+	if err != nil {
+		t.Fatalf("failed to query write status: %s", err)
+	}
+	if query.CommittedSize != d.SizeBytes || !query.Complete {
+		t.Errorf("expected complete upload of %d bytes, got %+v", d.SizeBytes, query)
+	}
+}
+
+func TestByteStreamMismatch(t *testing.T) {
+	srv := setup(t)
+	d := digest([]byte("expected blob"))
+
+	_, err := write(srv, &bs.WriteRequest{
+		ResourceName: uploadName(d),
+		Data:         []byte("altered blob!"),
+		FinishWrite:  true,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected status %s, got %s", codes.InvalidArgument, status.Code(err))
+	}
+
+	_, err = read(srv, &bs.ReadRequest{
+		ResourceName: blobName(d),
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected status %s, got %s", codes.NotFound, status.Code(err))
+	}
+}
+
+func TestByteStreamZstd(t *testing.T) {
+	srv := setup(t)
+	data := bytes.Repeat([]byte("compressible blob "), 100)
+	d := digest(data)
+
+	enc, _ := zstd.NewWriter(nil)
+	compressed := enc.EncodeAll(data, nil)
+	_, err := write(srv, &bs.WriteRequest{
+		ResourceName: fmt.Sprintf("uploads/a4e6/compressed-blobs/zstd/%s/%d", d.Hash, d.SizeBytes),
+		Data:         compressed,
+		FinishWrite:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to write blob: %s", err)
+	}
+
+	have, err := read(srv, &bs.ReadRequest{
+		ResourceName: fmt.Sprintf("compressed-blobs/zstd/%s/%d", d.Hash, d.SizeBytes),
+	})
+	if err != nil {
+		t.Fatalf("failed to read blob: %s", err)
+	}
+	dec, _ := zstd.NewReader(nil)
+	have, err = dec.DecodeAll(have, nil)
+	if err != nil {
+		t.Fatalf("failed to decompress blob: %s", err)
+	}
+	if !bytes.Equal(have, data) {
+		t.Errorf("expected value \"%s\", got \"%s\"", data, have)
+	}
+
+	// a resumed read is offset into the uncompressed blob
+	have, err = read(srv, &bs.ReadRequest{
+		ResourceName: fmt.Sprintf("compressed-blobs/zstd/%s/%d", d.Hash, d.SizeBytes),
+		ReadOffset:   100,
+		ReadLimit:    500,
+	})
+	if err != nil {
+		t.Fatalf("failed to read blob: %s", err)
+	}
+	have, err = dec.DecodeAll(have, nil)
+	if err != nil {
+		t.Fatalf("failed to decompress blob: %s", err)
+	}
+	if want := data[100:600]; !bytes.Equal(have, want) {
+		t.Errorf("expected value \"%s\", got \"%s\"", want, have)
+	}
+}
+
+type readStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	data bytes.Buffer
+}
+
+func (s *readStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *readStream) Send(res *bs.ReadResponse) error {
+	s.data.Write(res.Data)
+	return nil
+}
+
+// writeStream sends each request and then fails as if the client
+// disconnected.
+type writeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs []*bs.WriteRequest
+	res  *bs.WriteResponse
+}
+
+func (s *writeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *writeStream) Recv() (*bs.WriteRequest, error) {
+	if len(s.reqs) == 0 {
+		return nil, status.Error(codes.Unavailable, "client disconnected")
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+func (s *writeStream) SendAndClose(res *bs.WriteResponse) error {
+	s.res = res
+	return nil
+}
@@ -0,0 +1,33 @@
+package reapi
+
+import (
+	"context"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+)
+
+// GetCapabilities describes the caching features supported by the server.
+// Requests for an instance which is not served are rejected.
+func (s *Server) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.ServerCapabilities, error) {
+	if _, err := s.instance(req.InstanceName); err != nil {
+		return nil, err
+	}
+	return &pb.ServerCapabilities{
+		CacheCapabilities: &pb.CacheCapabilities{
+			DigestFunctions: []pb.DigestFunction_Value{
+				digestFunctions[s.digest],
+			},
+			ActionCacheUpdateCapabilities: &pb.ActionCacheUpdateCapabilities{
+				UpdateEnabled: true,
+			},
+			MaxBatchTotalSizeBytes:      s.maxBatchSize,
+			SymlinkAbsolutePathStrategy: pb.SymlinkAbsolutePathStrategy_ALLOWED,
+			SupportedCompressors: []pb.Compressor_Value{
+				pb.Compressor_ZSTD,
+			},
+		},
+		LowApiVersion:  &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2},
+	}, nil
+}
@@ -0,0 +1,284 @@
+package reapi
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultTreePageSize is the number of directories returned in each GetTree
+// response when the client does not request a page size.
+const defaultTreePageSize = 1000
+
+// FindMissingBlobs returns the digests of the requested blobs which are not in
+// the CAS.
+func (s *Server) FindMissingBlobs(ctx context.Context, req *pb.FindMissingBlobsRequest) (*pb.FindMissingBlobsResponse, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.ReadCAS); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(req.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := req.BlobDigests
+	for _, digest := range digests {
+		if err := s.checkDigest(digest); err != nil {
+			return nil, err
+		}
+	}
+
+	// check for each blob concurrently
+	missing := make([]bool, len(digests))
+	errs := make([]error, len(digests))
+	sem := make(chan struct{}, findConcurrency)
+	wg := sync.WaitGroup{}
+	for i := range digests {
+		if s.isEmpty(digests[i]) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ok, err := cache.Contains(ctx, inst.CAS, digests[i].Hash)
+			missing[i] = !ok
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	res := &pb.FindMissingBlobsResponse{}
+	for i, digest := range digests {
+		if errs[i] != nil {
+			s.logError(errs[i], digest.Hash, "cache error")
+			return nil, cacheError(errs[i])
+		}
+		if missing[i] {
+			res.MissingBlobDigests = append(res.MissingBlobDigests, digest)
+		}
+	}
+	return res, nil
+}
+
+// BatchUpdateBlobs stores a batch of blobs in the CAS. Each blob is verified
+// against its digest before it is stored.
+func (s *Server) BatchUpdateBlobs(ctx context.Context, req *pb.BatchUpdateBlobsRequest) (*pb.BatchUpdateBlobsResponse, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.WriteCAS); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(req.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, blob := range req.Requests {
+		total += int64(len(blob.Data))
+	}
+	if total > s.maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "batch size %d exceeds limit of %d bytes", total, s.maxBatchSize)
+	}
+
+	res := &pb.BatchUpdateBlobsResponse{
+		Responses: make([]*pb.BatchUpdateBlobsResponse_Response, len(req.Requests)),
+	}
+	for i, blob := range req.Requests {
+		res.Responses[i] = &pb.BatchUpdateBlobsResponse_Response{
+			Digest: blob.Digest,
+			Status: status.Convert(s.updateBlob(ctx, inst.CAS, blob.Digest, blob.Data)).Proto(),
+		}
+	}
+	return res, nil
+}
+
+// updateBlob verifies and stores a single blob in the CAS.
+func (s *Server) updateBlob(ctx context.Context, cas cache.Cache, digest *pb.Digest, data []byte) error {
+	if err := s.checkDigest(digest); err != nil {
+		return err
+	}
+	if int64(len(data)) != digest.SizeBytes {
+		return status.Errorf(codes.InvalidArgument, "blob size %d does not match digest size %d", len(data), digest.SizeBytes)
+	}
+	if s.digest.Sum(data) != digest.Hash {
+		return status.Errorf(codes.InvalidArgument, "blob does not match digest %s", digest.Hash)
+	}
+	if s.isEmpty(digest) {
+		return nil
+	}
+
+	err := s.casCodec.Put(ctx, cas, digest.Hash, bytes.NewReader(data), digest.SizeBytes, s.bufferSize)
+	if err != nil {
+		s.logError(err, digest.Hash, "cache error")
+		return cacheError(err)
+	}
+	s.logDebug(digest.Hash, "cache put")
+	return nil
+}
+
+// BatchReadBlobs returns a batch of blobs from the CAS.
+func (s *Server) BatchReadBlobs(ctx context.Context, req *pb.BatchReadBlobsRequest) (*pb.BatchReadBlobsResponse, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.ReadCAS); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(req.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, digest := range req.Digests {
+		if err := s.checkDigest(digest); err != nil {
+			return nil, err
+		}
+		total += digest.SizeBytes
+	}
+	if total > s.maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "batch size %d exceeds limit of %d bytes", total, s.maxBatchSize)
+	}
+
+	res := &pb.BatchReadBlobsResponse{
+		Responses: make([]*pb.BatchReadBlobsResponse_Response, len(req.Digests)),
+	}
+	for i, digest := range req.Digests {
+		data, err := s.readBlob(ctx, inst.CAS, digest)
+		res.Responses[i] = &pb.BatchReadBlobsResponse_Response{
+			Digest: digest,
+			Data:   data,
+			Status: status.Convert(err).Proto(),
+		}
+	}
+	return res, nil
+}
+
+// readBlob reads a single blob from the CAS.
+func (s *Server) readBlob(ctx context.Context, cas cache.Cache, digest *pb.Digest) ([]byte, error) {
+	if s.isEmpty(digest) {
+		return []byte{}, nil
+	}
+
+	rdr, err := codec.Get(ctx, cas, digest.Hash)
+	if cache.IsMiss(err) {
+		s.logDebug(digest.Hash, "cache miss")
+		return nil, cacheError(err)
+	} else if err != nil {
+		s.logError(err, digest.Hash, "cache error")
+		return nil, cacheError(err)
+	}
+	defer rdr.Close()
+
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		s.logError(err, digest.Hash, "i/o error")
+		return nil, cacheError(err)
+	}
+	s.logDebug(digest.Hash, "cache hit")
+	return data, nil
+}
+
+// GetTree returns the directories in the tree rooted at the requested
+// directory in breadth first order. Directories missing from the CAS are
+// omitted along with their descendants. The page token is the number of
+// directories already returned to the client.
+func (s *Server) GetTree(req *pb.GetTreeRequest, stream pb.ContentAddressableStorage_GetTreeServer) error {
+	ctx, cancel := s.withTimeout(stream.Context())
+	defer cancel()
+
+	if err := s.authorize(ctx, auth.ReadCAS); err != nil {
+		return err
+	}
+	inst, err := s.instance(req.InstanceName)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkDigest(req.RootDigest); err != nil {
+		return err
+	}
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 || pageSize > defaultTreePageSize {
+		pageSize = defaultTreePageSize
+	}
+	var skip int
+	if req.PageToken != "" {
+		var err error
+		skip, err = strconv.Atoi(req.PageToken)
+		if err != nil || skip < 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid page token %q", req.PageToken)
+		}
+	}
+
+	root, err := s.readDirectory(ctx, inst.CAS, req.RootDigest)
+	if err != nil {
+		return err
+	}
+
+	var position int
+	page := &pb.GetTreeResponse{}
+	queue := []*pb.Directory{root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		for _, node := range dir.Directories {
+			child, err := s.readDirectory(ctx, inst.CAS, node.Digest)
+			if status.Code(err) == codes.NotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			queue = append(queue, child)
+		}
+
+		position++
+		if position <= skip {
+			continue
+		}
+		if len(page.Directories) == pageSize {
+			page.NextPageToken = strconv.Itoa(position - 1)
+			if err := stream.Send(page); err != nil {
+				return err
+			}
+			page = &pb.GetTreeResponse{}
+		}
+		page.Directories = append(page.Directories, dir)
+	}
+	return stream.Send(page)
+}
+
+// readDirectory reads and decodes a directory from the CAS.
+func (s *Server) readDirectory(ctx context.Context, cas cache.Cache, digest *pb.Digest) (*pb.Directory, error) {
+	if err := s.checkDigest(digest); err != nil {
+		return nil, err
+	}
+	data, err := s.readBlob(ctx, cas, digest)
+	if err != nil {
+		return nil, err
+	}
+	dir := &pb.Directory{}
+	if err := proto.Unmarshal(data, dir); err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid directory %s: %s", digest.Hash, err)
+	}
+	return dir, nil
+}
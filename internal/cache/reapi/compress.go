@@ -0,0 +1,56 @@
+package reapi
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdReader reads the zstd compressed contents of a source reader.
+type zstdReader struct {
+	*io.PipeReader
+	src  io.ReadCloser
+	done chan struct{}
+}
+
+// newZstdReader returns a reader which compresses the contents of src. Closing
+// the returned reader closes src.
+func newZstdReader(src io.ReadCloser) io.ReadCloser {
+	pipeRdr, pipeWrt := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		enc, err := zstd.NewWriter(pipeWrt)
+		if err != nil {
+			pipeWrt.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(enc, src)
+		closeErr := enc.Close()
+		if err == nil {
+			err = closeErr
+		}
+		pipeWrt.CloseWithError(err)
+	}()
+	return &zstdReader{
+		PipeReader: pipeRdr,
+		src:        src,
+		done:       done,
+	}
+}
+
+// Close stops the compressor and closes the source reader.
+func (r *zstdReader) Close() error {
+	r.PipeReader.Close()
+	<-r.done
+	return r.src.Close()
+}
+
+// newZstdDecoder returns a reader which decompresses the contents of src.
+func newZstdDecoder(src io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
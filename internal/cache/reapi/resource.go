@@ -0,0 +1,70 @@
+package reapi
+
+import (
+	"strconv"
+	"strings"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// compressorZstd is the resource name component of zstd compressed blobs.
+const compressorZstd = "zstd"
+
+// resource is a parsed ByteStream resource name. Read resources have the form
+// "[{instance}/]blobs/{hash}/{size}" and write resources have the form
+// "[{instance}/]uploads/{uuid}/blobs/{hash}/{size}". Either may refer to
+// compressed data by replacing "blobs" with "compressed-blobs/{compressor}".
+// Trailing components are ignored.
+type resource struct {
+	instance   string
+	digest     *pb.Digest
+	compressor string // empty if the data is not compressed
+}
+
+// parseResource parses a read resource name or, if upload is true, a write
+// resource name. An InvalidArgument error is returned if the name is
+// malformed.
+func (s *Server) parseResource(name string, upload bool) (*resource, error) {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if part != "blobs" && part != "compressed-blobs" {
+			continue
+		}
+		if upload && (i < 2 || parts[i-2] != "uploads") {
+			break
+		}
+
+		res := &resource{
+			instance: strings.Join(parts[:i], "/"),
+		}
+		if upload {
+			res.instance = strings.Join(parts[:i-2], "/")
+		}
+		rest := parts[i+1:]
+		if part == "compressed-blobs" {
+			if len(rest) == 0 || rest[0] != compressorZstd {
+				return nil, status.Errorf(codes.InvalidArgument, "unsupported compressor in resource %q", name)
+			}
+			res.compressor = rest[0]
+			rest = rest[1:]
+		}
+		if len(rest) < 2 {
+			break
+		}
+		size, err := strconv.ParseInt(rest[1], 10, 64)
+		if err != nil {
+			break
+		}
+		res.digest = &pb.Digest{
+			Hash:      rest[0],
+			SizeBytes: size,
+		}
+		if err := s.checkDigest(res.digest); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "invalid resource %q", name)
+}
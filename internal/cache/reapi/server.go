@@ -0,0 +1,233 @@
+package reapi
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	"github.com/zenreach/hydroponics/internal/digest"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultBufferSize is the default size of the buffer used to stream
+	// blobs to and from the cache.
+	DefaultBufferSize = 32 * 1024
+
+	// DefaultMaxBatchSize is the default limit on the total size of the blobs
+	// in a batch request. It leaves room for message overhead within gRPC's
+	// default 4MiB message size limit.
+	DefaultMaxBatchSize = 4*1024*1024 - 64*1024
+
+	// findConcurrency is the number of blobs checked in parallel by
+	// FindMissingBlobs.
+	findConcurrency = 16
+)
+
+// digestFunctions maps the supported hash functions to their API values.
+var digestFunctions = map[*digest.Function]pb.DigestFunction_Value{
+	digest.SHA256: pb.DigestFunction_SHA256,
+	digest.BLAKE3: pb.DigestFunction_BLAKE3,
+}
+
+// Config configures the remote execution API services.
+type Config struct {
+	// Timeout is the maximum duration of a request. A zero value disables the
+	// timeout.
+	Timeout time.Duration
+
+	// BufferSize is the size of the buffer used to stream blobs to and from
+	// the cache. Defaults to DefaultBufferSize.
+	BufferSize int
+
+	// MaxBatchSize is the maximum total size of the blobs in a batch request.
+	// Defaults to DefaultMaxBatchSize.
+	MaxBatchSize int64
+
+	// UploadDir is the directory in which partial ByteStream uploads are
+	// spooled. Defaults to the system temporary directory.
+	UploadDir string
+
+	// Digest is the hash function used to address blobs. Defaults to
+	// digest.SHA256.
+	Digest *digest.Function
+
+	// CASCodec and ACCodec compress the blobs and action results put into the
+	// CAS and AC of every instance. Defaults to the default codec.
+	CASCodec *codec.Codec
+	ACCodec  *codec.Codec
+
+	// Instances are served in addition to the CAS and AC passed to New, which
+	// serve requests without an instance name. Requests for any other
+	// instance are rejected.
+	Instances []Instance
+}
+
+// Instance is a named pair of CAS and AC caches. Requests are routed to it by
+// their instance name.
+type Instance struct {
+	Name string
+	CAS  cache.Cache
+	AC   cache.Cache
+}
+
+// Server implements the ContentAddressableStorage, ActionCache, Capabilities,
+// and ByteStream services of the Bazel remote execution API. Blobs are stored
+// in the same format used by the HTTP cache handler so that both protocols may
+// share the same caches.
+type Server struct {
+	instances    map[string]Instance
+	casCodec     *codec.Codec
+	acCodec      *codec.Codec
+	timeout      time.Duration
+	bufferSize   int
+	maxBatchSize int64
+	digest       *digest.Function
+	uploads      *uploads
+	logger       hatchet.Logger
+}
+
+// New returns a server backed by the given CAS and AC caches and the instances
+// in the config.
+func New(cas cache.Cache, ac cache.Cache, cfg Config, logger hatchet.Logger) *Server {
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	maxBatchSize := cfg.MaxBatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = DefaultMaxBatchSize
+	}
+	digestFn := cfg.Digest
+	if digestFn == nil {
+		digestFn = digest.SHA256
+	}
+	instances := map[string]Instance{
+		"": {CAS: cas, AC: ac},
+	}
+	for _, inst := range cfg.Instances {
+		instances[inst.Name] = inst
+	}
+	return &Server{
+		instances:    instances,
+		casCodec:     cfg.CASCodec,
+		acCodec:      cfg.ACCodec,
+		timeout:      cfg.Timeout,
+		bufferSize:   bufferSize,
+		maxBatchSize: maxBatchSize,
+		digest:       digestFn,
+		uploads:      newUploads(cfg.UploadDir),
+		logger:       logger,
+	}
+}
+
+// Register the server's services with a gRPC server.
+func (s *Server) Register(srv *grpc.Server) {
+	pb.RegisterContentAddressableStorageServer(srv, s)
+	pb.RegisterActionCacheServer(srv, s)
+	pb.RegisterCapabilitiesServer(srv, s)
+	bs.RegisterByteStreamServer(srv, s)
+}
+
+// Close discards partial uploads. It should be called after the gRPC server
+// has stopped.
+func (s *Server) Close() {
+	s.uploads.close()
+}
+
+// withTimeout applies the configured timeout to a request context.
+func (s *Server) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout > 0 {
+		return context.WithTimeout(ctx, s.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// instance returns the named instance. An InvalidArgument error is returned
+// if the instance is not served. NotFound is not used as clients treat it as a
+// cache miss.
+func (s *Server) instance(name string) (Instance, error) {
+	inst, ok := s.instances[name]
+	if !ok {
+		return Instance{}, status.Errorf(codes.InvalidArgument, "unknown instance %q", name)
+	}
+	return inst, nil
+}
+
+// authorize returns a PermissionDenied error if the principal which made the
+// request does not have the permission. Every request is authorized if
+// authentication is disabled.
+func (s *Server) authorize(ctx context.Context, permission auth.Permission) error {
+	if auth.Permissions(ctx).Has(permission) {
+		return nil
+	}
+	method, _ := grpc.Method(ctx)
+	s.logger.Log(hatchet.L{
+		"message":    "permission denied",
+		"level":      "info",
+		"method":     method,
+		"permission": permission.String(),
+		"principal":  auth.Principal(ctx),
+	})
+	return status.Errorf(codes.PermissionDenied, "%s permission required", permission)
+}
+
+func (s *Server) logDebug(key, msg string) {
+	s.logger.Log(hatchet.L{
+		"message": msg,
+		"key":     key,
+		"level":   "debug",
+	})
+}
+
+func (s *Server) logError(err error, key, msg string) {
+	s.logger.Log(hatchet.L{
+		"message": msg,
+		"key":     key,
+		"level":   "error",
+		"error":   err,
+	})
+}
+
+// checkDigest returns an InvalidArgument error if the digest is malformed.
+func (s *Server) checkDigest(digest *pb.Digest) error {
+	if digest == nil {
+		return status.Error(codes.InvalidArgument, "missing digest")
+	}
+	if !s.digest.Valid(digest.Hash) {
+		return status.Errorf(codes.InvalidArgument, "invalid digest hash %q", digest.Hash)
+	}
+	if digest.SizeBytes < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid digest size %d", digest.SizeBytes)
+	}
+	return nil
+}
+
+// isEmpty returns true if the digest refers to the empty blob. The empty blob
+// is always present and never stored.
+func (s *Server) isEmpty(digest *pb.Digest) bool {
+	return digest.SizeBytes == 0 && digest.Hash == s.digest.Empty()
+}
+
+// cacheError converts a cache error to a gRPC status error.
+func cacheError(err error) error {
+	switch {
+	case cache.IsMiss(err):
+		return status.Error(codes.NotFound, err.Error())
+	case err == context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case err == context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
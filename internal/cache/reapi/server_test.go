@@ -0,0 +1,394 @@
+package reapi_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/auth"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/codec"
+	"github.com/zenreach/hydroponics/internal/cache/memory"
+	"github.com/zenreach/hydroponics/internal/cache/reapi"
+	digestfn "github.com/zenreach/hydroponics/internal/digest"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func setup(t *testing.T) *reapi.Server {
+	t.Parallel()
+	return reapi.New(memory.New(64*1024*1024, 16*1024*1024), memory.New(64*1024*1024, 16*1024*1024), reapi.Config{
+		Timeout: 15 * time.Second,
+		Instances: []reapi.Instance{
+			{
+				Name: "instance",
+				CAS:  memory.New(64*1024*1024, 16*1024*1024),
+				AC:   memory.New(64*1024*1024, 16*1024*1024),
+			},
+		},
+	}, hatchet.Test(t))
+}
+
+func digest(data []byte) *pb.Digest {
+	sum := sha256.Sum256(data)
+	return &pb.Digest{
+		Hash:      hex.EncodeToString(sum[:]),
+		SizeBytes: int64(len(data)),
+	}
+}
+
+func update(t *testing.T, srv *reapi.Server, blobs ...[]byte) {
+	req := &pb.BatchUpdateBlobsRequest{}
+	for _, blob := range blobs {
+		req.Requests = append(req.Requests, &pb.BatchUpdateBlobsRequest_Request{
+			Digest: digest(blob),
+			Data:   blob,
+		})
+	}
+	res, err := srv.BatchUpdateBlobs(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to update blobs: %s", err)
+	}
+	for _, blobRes := range res.Responses {
+		if code := codes.Code(blobRes.Status.GetCode()); code != codes.OK {
+			t.Fatalf("failed to update blob %s: %s", blobRes.Digest.Hash, code)
+		}
+	}
+}
+
+func TestBatchUpdateRead(t *testing.T) {
+	srv := setup(t)
+	blobs := [][]byte{[]byte("first blob"), []byte("second blob"), []byte{}}
+	update(t, srv, blobs...)
+
+	missing := []byte("missing blob")
+	req := &pb.BatchReadBlobsRequest{}
+	for _, blob := range append(blobs, missing) {
+		req.Digests = append(req.Digests, digest(blob))
+	}
+	res, err := srv.BatchReadBlobs(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to read blobs: %s", err)
+	}
+	if len(res.Responses) != len(req.Digests) {
+		t.Fatalf("expected %d responses, got %d", len(req.Digests), len(res.Responses))
+	}
+	for i, blob := range blobs {
+		blobRes := res.Responses[i]
+		if code := codes.Code(blobRes.Status.GetCode()); code != codes.OK {
+			t.Errorf("expected status %s, got %s", codes.OK, code)
+		}
+		if string(blobRes.Data) != string(blob) {
+			t.Errorf("expected value \"%s\", got \"%s\"", blob, blobRes.Data)
+		}
+	}
+	if code := codes.Code(res.Responses[len(blobs)].Status.GetCode()); code != codes.NotFound {
+		t.Errorf("expected status %s, got %s", codes.NotFound, code)
+	}
+}
+
+func TestBatchUpdateInvalid(t *testing.T) {
+	srv := setup(t)
+	req := &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{
+			{
+				Digest: digest([]byte("expected blob")),
+				Data:   []byte("altered blob!"),
+			},
+		},
+	}
+	res, err := srv.BatchUpdateBlobs(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to update blobs: %s", err)
+	}
+	if code := codes.Code(res.Responses[0].Status.GetCode()); code != codes.InvalidArgument {
+		t.Errorf("expected status %s, got %s", codes.InvalidArgument, code)
+	}
+}
+
+func TestDigestFunction(t *testing.T) {
+	t.Parallel()
+	srv := reapi.New(memory.New(1024*1024, 1024*1024), memory.New(1024*1024, 1024*1024), reapi.Config{
+		Digest: digestfn.BLAKE3,
+	}, hatchet.Test(t))
+
+	caps, err := srv.GetCapabilities(context.Background(), &pb.GetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("failed to get capabilities: %s", err)
+	}
+	funcs := caps.CacheCapabilities.DigestFunctions
+	if len(funcs) != 1 || funcs[0] != pb.DigestFunction_BLAKE3 {
+		t.Errorf("expected digest functions %v, got %v", []pb.DigestFunction_Value{pb.DigestFunction_BLAKE3}, funcs)
+	}
+
+	// blobs are verified with the configured function
+	blob := []byte("blake3 blob")
+	res, err := srv.BatchUpdateBlobs(context.Background(), &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{
+			{Digest: &pb.Digest{Hash: digestfn.BLAKE3.Sum(blob), SizeBytes: int64(len(blob))}, Data: blob},
+			{Digest: digest(blob), Data: blob},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to update blobs: %s", err)
+	}
+	want := []codes.Code{codes.OK, codes.InvalidArgument}
+	for i, blobRes := range res.Responses {
+		if code := codes.Code(blobRes.Status.GetCode()); code != want[i] {
+			t.Errorf("expected status %s, got %s", want[i], code)
+		}
+	}
+}
+
+func TestFindMissingBlobs(t *testing.T) {
+	srv := setup(t)
+	present := []byte("present blob")
+	missing := []byte("missing blob")
+	update(t, srv, present)
+
+	res, err := srv.FindMissingBlobs(context.Background(), &pb.FindMissingBlobsRequest{
+		BlobDigests: []*pb.Digest{digest(present), digest(missing), digest(nil)},
+	})
+	if err != nil {
+		t.Fatalf("failed to find missing blobs: %s", err)
+	}
+	if len(res.MissingBlobDigests) != 1 || res.MissingBlobDigests[0].Hash != digest(missing).Hash {
+		t.Errorf("expected only %s to be missing, got %v", digest(missing).Hash, res.MissingBlobDigests)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	t.Parallel()
+	casCodec, err := codec.New(codec.Config{Encoding: codec.Zstd})
+	if err != nil {
+		t.Fatalf("failed to create codec: %s", err)
+	}
+	cas := memory.New(64*1024*1024, 16*1024*1024)
+	srv := reapi.New(cas, memory.New(64*1024*1024, 16*1024*1024), reapi.Config{
+		CASCodec: casCodec,
+	}, hatchet.Test(t))
+
+	blob := bytes.Repeat([]byte("compressible blob "), 1024)
+	update(t, srv, blob)
+	info := cachetest.AssertStat(t, cas, digest(blob).Hash)
+	if info.ContentEncoding != codec.Zstd {
+		t.Errorf("expected encoding %q, got %q", codec.Zstd, info.ContentEncoding)
+	}
+
+	res, err := srv.BatchReadBlobs(context.Background(), &pb.BatchReadBlobsRequest{
+		Digests: []*pb.Digest{digest(blob)},
+	})
+	if err != nil {
+		t.Fatalf("failed to read blobs: %s", err)
+	}
+	if !bytes.Equal(res.Responses[0].Data, blob) {
+		t.Errorf("expected %d byte blob, got %d bytes", len(blob), len(res.Responses[0].Data))
+	}
+}
+
+func TestActionResult(t *testing.T) {
+	srv := setup(t)
+	action := digest([]byte("action"))
+	want := &pb.ActionResult{
+		ExitCode:     1,
+		StdoutDigest: digest([]byte("stdout")),
+	}
+
+	_, err := srv.GetActionResult(context.Background(), &pb.GetActionResultRequest{
+		ActionDigest: action,
+	})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("expected status %s, got %s", codes.NotFound, code)
+	}
+
+	_, err = srv.UpdateActionResult(context.Background(), &pb.UpdateActionResultRequest{
+		ActionDigest: action,
+		ActionResult: want,
+	})
+	if err != nil {
+		t.Fatalf("failed to update action result: %s", err)
+	}
+
+	have, err := srv.GetActionResult(context.Background(), &pb.GetActionResultRequest{
+		ActionDigest: action,
+	})
+	if err != nil {
+		t.Fatalf("failed to get action result: %s", err)
+	}
+	if !proto.Equal(have, want) {
+		t.Errorf("expected action result %v, got %v", want, have)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	srv := setup(t)
+	blob := []byte("trusted blob")
+	update(t, srv, blob)
+	action := digest([]byte("action"))
+
+	// a fork may read the cache but not write to it
+	ctx := auth.NewContext(context.Background(), "fork", auth.Read)
+	_, err := srv.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{
+		Digests: []*pb.Digest{digest(blob)},
+	})
+	if err != nil {
+		t.Errorf("failed to read blobs: %s", err)
+	}
+	_, err = srv.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{
+			{Digest: digest([]byte("fork blob")), Data: []byte("fork blob")},
+		},
+	})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("expected status %s, got %s", codes.PermissionDenied, code)
+	}
+	_, err = srv.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		ActionDigest: action,
+		ActionResult: &pb.ActionResult{},
+	})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("expected status %s, got %s", codes.PermissionDenied, code)
+	}
+
+	// a principal without permissions may do nothing
+	ctx = auth.NewContext(context.Background(), "nobody", auth.None)
+	_, err = srv.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{
+		BlobDigests: []*pb.Digest{digest(blob)},
+	})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("expected status %s, got %s", codes.PermissionDenied, code)
+	}
+	_, err = srv.GetActionResult(ctx, &pb.GetActionResultRequest{
+		ActionDigest: action,
+	})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("expected status %s, got %s", codes.PermissionDenied, code)
+	}
+	err = srv.Read(&bs.ReadRequest{ResourceName: blobName(digest(blob))}, &readStream{ctx: ctx})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("expected status %s, got %s", codes.PermissionDenied, code)
+	}
+	err = srv.Write(&writeStream{ctx: ctx})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("expected status %s, got %s", codes.PermissionDenied, code)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	srv := setup(t)
+	blob := []byte("default blob")
+	update(t, srv, blob)
+
+	// instances do not share blobs
+	res, err := srv.FindMissingBlobs(context.Background(), &pb.FindMissingBlobsRequest{
+		InstanceName: "instance",
+		BlobDigests:  []*pb.Digest{digest(blob)},
+	})
+	if err != nil {
+		t.Fatalf("failed to find missing blobs: %s", err)
+	}
+	if len(res.MissingBlobDigests) != 1 {
+		t.Errorf("expected blob to be missing from instance")
+	}
+	_, err = read(srv, &bs.ReadRequest{ResourceName: blobName(digest(blob))})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("expected status %s, got %s", codes.NotFound, code)
+	}
+
+	// unknown instances are rejected
+	_, err = srv.BatchReadBlobs(context.Background(), &pb.BatchReadBlobsRequest{
+		InstanceName: "unknown",
+		Digests:      []*pb.Digest{digest(blob)},
+	})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected status %s, got %s", codes.InvalidArgument, code)
+	}
+	_, err = srv.GetActionResult(context.Background(), &pb.GetActionResultRequest{
+		InstanceName: "unknown",
+		ActionDigest: digest([]byte("action")),
+	})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected status %s, got %s", codes.InvalidArgument, code)
+	}
+	_, err = read(srv, &bs.ReadRequest{ResourceName: "unknown/" + blobName(digest(blob))})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected status %s, got %s", codes.InvalidArgument, code)
+	}
+	_, err = srv.GetCapabilities(context.Background(), &pb.GetCapabilitiesRequest{
+		InstanceName: "unknown",
+	})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected status %s, got %s", codes.InvalidArgument, code)
+	}
+}
+
+func TestGetTree(t *testing.T) {
+	srv := setup(t)
+	leaf := marshal(t, &pb.Directory{
+		Files: []*pb.FileNode{{Name: "file", Digest: digest([]byte("file"))}},
+	})
+	root := marshal(t, &pb.Directory{
+		Directories: []*pb.DirectoryNode{
+			{Name: "leaf", Digest: digest(leaf)},
+			{Name: "missing", Digest: digest([]byte("missing"))},
+		},
+	})
+	update(t, srv, root, leaf)
+
+	stream := &treeStream{ctx: context.Background()}
+	err := srv.GetTree(&pb.GetTreeRequest{
+		RootDigest: digest(root),
+		PageSize:   1,
+	}, stream)
+	if err != nil {
+		t.Fatalf("failed to get tree: %s", err)
+	}
+
+	if len(stream.pages) != 2 {
+		t.Fatalf("expected 2 pages, got %d", len(stream.pages))
+	}
+	if stream.pages[0].NextPageToken != "1" {
+		t.Errorf("expected page token \"1\", got \"%s\"", stream.pages[0].NextPageToken)
+	}
+	want := []string{string(root), string(leaf)}
+	for i, page := range stream.pages {
+		if len(page.Directories) != 1 {
+			t.Errorf("expected 1 directory in page %d, got %d", i, len(page.Directories))
+			continue
+		}
+		if have := string(marshal(t, page.Directories[0])); have != want[i] {
+			t.Errorf("unexpected directory in page %d", i)
+		}
+	}
+}
+
+type treeStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	pages []*pb.GetTreeResponse
+}
+
+func (s *treeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *treeStream) Send(res *pb.GetTreeResponse) error {
+	s.pages = append(s.pages, res)
+	return nil
+}
+
+func marshal(t *testing.T, msg proto.Message) []byte {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %s", err)
+	}
+	return data
+}
@@ -0,0 +1,143 @@
+package reapi
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// uploadExpiry is the time after which an inactive partial upload is
+// discarded.
+const uploadExpiry = time.Hour
+
+// uploads tracks partial ByteStream uploads so that they may be resumed. The
+// data for each upload is spooled to a temporary file until it is complete.
+type uploads struct {
+	dir    string
+	mu     sync.Mutex
+	active map[string]*upload
+}
+
+// upload is a partially written blob.
+type upload struct {
+	mu        sync.Mutex
+	file      *os.File
+	committed int64
+	updated   time.Time
+}
+
+func newUploads(dir string) *uploads {
+	return &uploads{
+		dir:    dir,
+		active: make(map[string]*upload),
+	}
+}
+
+// get returns the upload with the given resource name or nil if it does not
+// exist.
+func (u *uploads) get(name string) *upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.active[name]
+}
+
+// open returns the upload with the given resource name. A new upload is
+// created if it does not exist. Expired uploads are discarded.
+func (u *uploads) open(name string) (*upload, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(time.Now().Add(-uploadExpiry))
+
+	if up, ok := u.active[name]; ok {
+		return up, nil
+	}
+	file, err := ioutil.TempFile(u.dir, "upload-")
+	if err != nil {
+		return nil, err
+	}
+	up := &upload{
+		file:    file,
+		updated: time.Now(),
+	}
+	u.active[name] = up
+	return up, nil
+}
+
+// remove discards the upload with the given resource name.
+func (u *uploads) remove(name string) {
+	u.mu.Lock()
+	up := u.active[name]
+	delete(u.active, name)
+	u.mu.Unlock()
+	if up != nil {
+		up.discard()
+	}
+}
+
+// expire discards uploads which have not been written to since the given
+// time. The caller must hold the lock.
+func (u *uploads) expire(since time.Time) {
+	for name, up := range u.active {
+		up.mu.Lock()
+		expired := up.updated.Before(since)
+		up.mu.Unlock()
+		if expired {
+			delete(u.active, name)
+			up.discard()
+		}
+	}
+}
+
+// close discards all uploads.
+func (u *uploads) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, up := range u.active {
+		delete(u.active, name)
+		up.discard()
+	}
+}
+
+// write appends data to the upload at the given offset. The offset must match
+// the number of bytes already committed. Returns the new committed size.
+func (up *upload) write(offset int64, data []byte) (int64, error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if offset != up.committed {
+		return up.committed, status.Errorf(codes.InvalidArgument, "write offset %d does not match committed size %d", offset, up.committed)
+	}
+	n, err := up.file.WriteAt(data, offset)
+	up.committed += int64(n)
+	up.updated = time.Now()
+	if err != nil {
+		return up.committed, status.Errorf(codes.Internal, "failed to spool upload: %s", err)
+	}
+	return up.committed, nil
+}
+
+// size returns the number of bytes committed to the upload.
+func (up *upload) size() int64 {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.committed
+}
+
+// reader returns a reader of the committed upload data.
+func (up *upload) reader() io.Reader {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return io.NewSectionReader(up.file, 0, up.committed)
+}
+
+// discard closes and removes the spooled upload data.
+func (up *upload) discard() {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.file.Close()
+	os.Remove(up.file.Name())
+}
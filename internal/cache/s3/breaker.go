@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is the default number of consecutive failed S3
+	// requests which open the circuit breaker.
+	DefaultBreakerThreshold = 10
+
+	// DefaultBreakerCooldown is the default time the circuit breaker stays
+	// open before a request is allowed to probe S3.
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// breaker is a circuit breaker which stops requests to S3 after sustained
+// failures. While it is open reads miss and writes are dropped without
+// waiting on S3. Once the cooldown passes a single request is allowed through
+// to probe S3. The breaker closes if it succeeds and stays open for another
+// cooldown if it fails. A nil breaker is always closed.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int       // consecutive failures
+	openedAt time.Time // zero while closed
+	probing  bool      // a probe is in progress
+}
+
+func newBreaker(cfg Config) *breaker {
+	threshold := cfg.BreakerThreshold
+	if threshold < 0 {
+		return nil
+	}
+	if threshold == 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	cooldown := cfg.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow returns true if a request may be sent to S3. The caller must report
+// the outcome of an allowed request with success, failure, or abandon.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a successful request. It returns true if this closed the
+// breaker.
+func (b *breaker) success() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	if b.openedAt.IsZero() {
+		return false
+	}
+	b.openedAt = time.Time{}
+	return true
+}
+
+// failure records a failed request. It returns true if this opened the
+// breaker.
+func (b *breaker) failure() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if !b.openedAt.IsZero() {
+		if b.probing {
+			// wait another cooldown before the next probe
+			b.probing = false
+			b.openedAt = b.now()
+		}
+		return false
+	}
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openedAt = b.now()
+	return true
+}
+
+// abandon records a request which ended without a result, such as one
+// cancelled by the client. Another probe may be sent in its place.
+func (b *breaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
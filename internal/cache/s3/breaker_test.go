@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/cache"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(Config{BreakerThreshold: 3, BreakerCooldown: time.Minute})
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("expected closed breaker to allow request %d", i)
+		}
+		if b.failure() {
+			t.Fatalf("expected breaker to open after 3 failures, opened after %d", i+1)
+		}
+	}
+	if !b.failure() {
+		t.Fatal("expected breaker to open after 3 failures")
+	}
+	if b.allow() {
+		t.Fatal("expected open breaker to reject request")
+	}
+
+	// a single probe is allowed after the cooldown
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("expected probe after cooldown")
+	}
+	if b.allow() {
+		t.Fatal("expected second probe to be rejected")
+	}
+
+	// a failed probe waits for another cooldown
+	b.failure()
+	if b.allow() {
+		t.Fatal("expected request to be rejected after failed probe")
+	}
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("expected probe after second cooldown")
+	}
+
+	// an abandoned probe is replaced
+	b.abandon()
+	if !b.allow() {
+		t.Fatal("expected probe after abandoned probe")
+	}
+
+	if !b.success() {
+		t.Fatal("expected successful probe to close breaker")
+	}
+	if !b.allow() {
+		t.Fatal("expected closed breaker to allow request")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker(Config{BreakerThreshold: -1})
+	for i := 0; i < 2*DefaultBreakerThreshold; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Error("expected disabled breaker to allow request")
+	}
+}
+
+func TestBreakerOpen(t *testing.T) {
+	// nothing listens on the endpoint so any request would fail
+	c, err := New(Config{
+		Bucket:           "test-bucket",
+		Region:           "us-east-1",
+		Endpoint:         "http://127.0.0.1:1",
+		PathStyle:        true,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+	}, hatchet.Test(t))
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	defer c.Shutdown(context.Background())
+	c.breaker.failure()
+
+	ctx := context.Background()
+	key := "abcdef0123456789"
+	if _, err := c.Stat(ctx, key); err != cache.ErrUnavailable {
+		t.Errorf("expected stat to be unavailable, got %v", err)
+	}
+	if _, err := c.Get(ctx, key); err != cache.ErrUnavailable {
+		t.Errorf("expected get to be unavailable, got %v", err)
+	}
+	if _, err := c.GetRange(ctx, key, 0, 1); err != cache.ErrUnavailable {
+		t.Errorf("expected range to be unavailable, got %v", err)
+	}
+	if found, err := cache.Contains(ctx, c, key); found || err != nil {
+		t.Errorf("expected contains to miss, got %t, %v", found, err)
+	}
+
+	// dropped puts still read the object
+	data := bytes.NewBufferString("value")
+	if err := c.Put(ctx, key, data, cache.Metadata{ContentLength: -1}); err != nil {
+		t.Errorf("expected put to be dropped, got %s", err)
+	}
+	if data.Len() != 0 {
+		t.Errorf("expected dropped put to read the object, %d bytes left", data.Len())
+	}
+}
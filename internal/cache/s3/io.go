@@ -1,13 +1,36 @@
 package s3
 
 import (
+	"context"
 	"io"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/pipes"
 )
 
-type nopCloser struct {
-	io.Reader
+// download reads an object as it is downloaded. Closing it aborts the
+// download if it has not finished.
+type download struct {
+	*pipes.BlockPipe
+	cancel context.CancelFunc
+	meta   cache.Metadata
+}
+
+func (d *download) Metadata() cache.Metadata {
+	return d.meta
+}
+
+func (d *download) Close() error {
+	d.cancel()
+	return d.BlockPipe.CloseRead()
+}
+
+// rangeDownload reads the body of a ranged request.
+type rangeDownload struct {
+	io.ReadCloser
+	meta cache.Metadata
 }
 
-func (*nopCloser) Close() error {
-	return nil
+func (d *rangeDownload) Metadata() cache.Metadata {
+	return d.meta
 }
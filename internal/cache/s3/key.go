@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// MaxShardDepth is the maximum number of shard directories in an object key.
+const MaxShardDepth = 4
+
+// escape starts an escaped byte in an encoded key.
+const escape = '_'
+
+// encodeKey encodes a cache key as an S3 object key. Letters, digits, and
+// dashes are kept. Every other byte, including the escape character, is
+// replaced by an underscore followed by its two digit hex value. The encoding
+// is reversible so distinct keys never share an object. Hex digests are not
+// changed.
+func encodeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if isSafe(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%c%02x", escape, c)
+		}
+	}
+	return b.String()
+}
+
+// decodeKey reverses encodeKey.
+func decodeKey(encoded string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(encoded); i++ {
+		c := encoded[i]
+		if c != escape {
+			if !isSafe(c) {
+				return "", fmt.Errorf("invalid character %q in encoded key", c)
+			}
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(encoded) {
+			return "", fmt.Errorf("truncated escape in encoded key %q", encoded)
+		}
+		v, err := hex.DecodeString(encoded[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in encoded key %q", encoded)
+		}
+		b.WriteByte(v[0])
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isSafe(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+// shard returns the shard directories of a key, such as "ab/cd/" for a depth
+// of two. Keys which are lower case hex digests are sharded by their leading
+// characters. Other keys are sharded by the SHA-256 digest of the key so that
+// they are spread evenly.
+func shard(key string, depth int) string {
+	if depth <= 0 {
+		return ""
+	}
+	digest := key
+	if len(digest) < depth*2 || !isHex(digest) {
+		sum := sha256.Sum256([]byte(key))
+		digest = hex.EncodeToString(sum[:])
+	}
+	var b strings.Builder
+	for i := 0; i < depth; i++ {
+		b.WriteString(digest[i*2 : i*2+2])
+		b.WriteByte('/')
+	}
+	return b.String()
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
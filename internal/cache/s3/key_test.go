@@ -0,0 +1,54 @@
+package s3
+
+import (
+	"testing"
+)
+
+func TestEncodeKey(t *testing.T) {
+	tests := map[string]string{
+		"abcdef0123456789": "abcdef0123456789",
+		"Key-1":            "Key-1",
+		"a/b":              "a_2fb",
+		"a_b":              "a_5fb",
+		"a.b":              "a_2eb",
+		"":                 "",
+	}
+	for key, want := range tests {
+		have := encodeKey(key)
+		if have != want {
+			t.Errorf("expected %q to encode as %q, got %q", key, want, have)
+		}
+		decoded, err := decodeKey(have)
+		if err != nil {
+			t.Errorf("failed to decode %q: %s", have, err)
+		} else if decoded != key {
+			t.Errorf("expected %q to decode as %q, got %q", have, key, decoded)
+		}
+	}
+
+	for _, encoded := range []string{"a_2", "a_zz", "a/b"} {
+		if _, err := decodeKey(encoded); err == nil {
+			t.Errorf("expected an error decoding %q", encoded)
+		}
+	}
+}
+
+func TestShard(t *testing.T) {
+	tests := []struct {
+		key   string
+		depth int
+		want  string
+	}{
+		{"abcdef", 0, ""},
+		{"abcdef", 1, "ab/"},
+		{"abcdef", 3, "ab/cd/ef/"},
+		// too short or not hex so the digest of the key is used
+		{"abcd", 3, "88/d4/26/"},
+		{"a/b", 1, "c1/"},
+	}
+	for _, test := range tests {
+		if have := shard(test.key, test.depth); have != test.want {
+			t.Errorf("expected shard %q for %q at depth %d, got %q", test.want, test.key, test.depth, have)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// S3 operations recorded in metrics.
+const (
+	opHead       = "Head"
+	opGet        = "Get"
+	opGetRange   = "GetRange"
+	opUpload     = "Upload"
+	opCopyObject = "CopyObject"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hydroponics",
+		Subsystem: "s3",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of S3 operations by bucket, operation, and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"bucket", "operation", "result"})
+
+	downloadsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hydroponics",
+		Subsystem: "s3",
+		Name:      "downloads_in_flight",
+		Help:      "Number of S3 downloads in progress by bucket.",
+	}, []string{"bucket"})
+
+	refreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "s3",
+		Name:      "refreshes_total",
+		Help:      "Object refreshes by bucket and result.",
+	}, []string{"bucket", "result"})
+
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "s3",
+		Name:      "retries_total",
+		Help:      "Retried S3 requests by bucket and API operation.",
+	}, []string{"bucket", "operation"})
+
+	breakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hydroponics",
+		Subsystem: "s3",
+		Name:      "breaker_open",
+		Help:      "Whether the S3 circuit breaker is open by bucket and cache namespace.",
+	}, []string{"bucket", "namespace"})
+
+	breakerRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "s3",
+		Name:      "breaker_rejections_total",
+		Help:      "S3 operations skipped while the circuit breaker is open by bucket, cache namespace, and operation.",
+	}, []string{"bucket", "namespace", "operation"})
+)
+
+// observe records the duration of an S3 operation which began at start.
+func (c *Cache) observe(op string, start time.Time, err error) {
+	result := "ok"
+	if isErrCode(err, 404) {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+	}
+	requestDuration.WithLabelValues(c.bucket, op, result).Observe(time.Since(start).Seconds())
+}
+
+// observeRefresh records the result of a refresh.
+func (c *Cache) observeRefresh(result string) {
+	refreshesTotal.WithLabelValues(c.bucket, result).Inc()
+}
+
+// reject records an operation skipped by the open circuit breaker.
+func (c *Cache) reject(op string) {
+	breakerRejectionsTotal.WithLabelValues(c.bucket, c.namespace, op).Inc()
+}
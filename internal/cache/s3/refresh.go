@@ -0,0 +1,220 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/tracing"
+)
+
+const (
+	// DefaultRefreshAge is the default age after which an object is
+	// refreshed when it is read.
+	DefaultRefreshAge = 24 * time.Hour
+
+	// DefaultRefreshConcurrency is the default number of objects refreshed
+	// at once.
+	DefaultRefreshConcurrency = 4
+
+	// DefaultRefreshRate is the default maximum number of objects refreshed
+	// per second.
+	DefaultRefreshRate = 20
+
+	// refreshQueueSize is the number of refreshes which may wait for a
+	// worker. Refreshes are dropped while the queue is full. The object is
+	// refreshed by a later read.
+	refreshQueueSize = 1024
+)
+
+// Results of a refresh recorded in metrics.
+const (
+	refreshOK        = "ok"
+	refreshError     = "error"
+	refreshFresh     = "fresh"
+	refreshDuplicate = "duplicate"
+	refreshDropped   = "dropped"
+)
+
+// refreshRequest is an object waiting to be refreshed.
+type refreshRequest struct {
+	ctx  context.Context // traces the refresh as part of the read
+	key  string
+	meta cache.Metadata
+}
+
+// refresher copies objects onto themselves in the background to reset their
+// expiration. Objects which were refreshed recently are skipped and each key
+// is queued at most once. Copies are made by a fixed number of workers at a
+// limited rate.
+type refresher struct {
+	c      *Cache
+	maxAge time.Duration
+	queue  chan refreshRequest
+	limit  *time.Ticker
+	wg     sync.WaitGroup
+
+	// ctx aborts the remaining refreshes when shutdown times out
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	pending map[string]bool
+	closed  bool
+}
+
+func newRefresher(c *Cache, cfg Config) *refresher {
+	maxAge := cfg.RefreshAge
+	if maxAge <= 0 {
+		maxAge = DefaultRefreshAge
+	}
+	concurrency := cfg.RefreshConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultRefreshConcurrency
+	}
+	rate := cfg.RefreshRate
+	if rate <= 0 {
+		rate = DefaultRefreshRate
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &refresher{
+		c:       c,
+		maxAge:  maxAge,
+		queue:   make(chan refreshRequest, refreshQueueSize),
+		limit:   time.NewTicker(time.Duration(float64(time.Second) / rate)),
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: map[string]bool{},
+	}
+	r.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go r.work()
+	}
+	go func() {
+		r.wg.Wait()
+		r.limit.Stop()
+	}()
+	return r
+}
+
+// add queues a refresh of the object unless it was refreshed within the
+// maximum age or is already queued. The object's metadata must be provided
+// as it is replaced by the copy.
+func (r *refresher) add(ctx context.Context, key string, meta cache.Metadata, refreshed time.Time) {
+	if time.Since(refreshed) < r.maxAge {
+		r.c.observeRefresh(refreshFresh)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.pending[key] {
+		r.c.observeRefresh(refreshDuplicate)
+		return
+	}
+	select {
+	case r.queue <- refreshRequest{ctx: tracing.Detach(ctx), key: key, meta: meta}:
+		r.pending[key] = true
+	default:
+		r.c.observeRefresh(refreshDropped)
+	}
+}
+
+// close stops accepting refreshes. The workers exit once the queue is empty.
+func (r *refresher) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+}
+
+// wait blocks until the queued refreshes are complete. If the context expires
+// first then the remaining refreshes are aborted and ctx.Err() is returned.
+func (r *refresher) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		return ctx.Err()
+	}
+}
+
+func (r *refresher) work() {
+	defer r.wg.Done()
+	for req := range r.queue {
+		select {
+		case <-r.limit.C:
+			r.refresh(req)
+		case <-r.ctx.Done():
+		}
+		r.mu.Lock()
+		delete(r.pending, req.key)
+		r.mu.Unlock()
+	}
+}
+
+// refresh copies the object onto itself which resets its modification time.
+func (r *refresher) refresh(req refreshRequest) {
+	c := r.c
+	if !c.breaker.allow() {
+		c.reject(opCopyObject)
+		c.observeRefresh(refreshDropped)
+		return
+	}
+	realKey := c.realKey(req.key)
+	_, span := tracing.Start(req.ctx, "s3.touch", c.spanAttributes(realKey)...)
+	source := fmt.Sprintf("/%s/%s", c.bucket, realKey)
+	metadata := objectMetadata(req.meta)
+	metadata[metaRefreshed] = sp(strconv.FormatInt(time.Now().UTC().Unix(), 10))
+	start := time.Now()
+	_, err := c.client.CopyObjectWithContext(r.ctx, &s3.CopyObjectInput{
+		Bucket:            sp(c.bucket),
+		Key:               sp(realKey),
+		CopySource:        sp(source),
+		ContentEncoding:   contentEncoding(req.meta),
+		Metadata:          metadata,
+		MetadataDirective: sp("REPLACE"),
+	})
+	c.observe(opCopyObject, start, err)
+	c.record(r.ctx, err)
+	tracing.End(span, err)
+	if err == nil {
+		c.observeRefresh(refreshOK)
+		c.logDebug(realKey, source, "refresh key")
+	} else {
+		c.observeRefresh(refreshError)
+		c.logError(err, realKey, source, "key refresh error")
+	}
+}
+
+// refreshedAt returns the time at which an object was last refreshed. This is
+// the refreshed metadata of the object if it has any. Otherwise it is the
+// modification time as the object has not been copied since it was stored.
+func refreshedAt(metadata map[string]*string, lastModified time.Time) time.Time {
+	value, ok := getMetadata(metadata, metaRefreshed)
+	if !ok {
+		return lastModified
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return lastModified
+	}
+	return time.Unix(seconds, 0)
+}
@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	// DefaultRetries is the default number of times a failed S3 request is
+	// retried.
+	DefaultRetries = 3
+
+	// DefaultRetryBaseDelay is the default delay before the first retry.
+	DefaultRetryBaseDelay = 50 * time.Millisecond
+
+	// DefaultRetryMaxDelay is the default maximum delay between retries.
+	DefaultRetryMaxDelay = 5 * time.Second
+)
+
+// retryer retries failed S3 requests with jittered exponential backoff. The
+// SDK's default retryer decides which requests are retried. These include
+// throttling, connection errors, and 5xx responses such as 503 SlowDown. Each
+// request is retried on its own so a multipart download or upload only
+// repeats the part which failed.
+type retryer struct {
+	client.DefaultRetryer
+	bucket    string
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+func newRetryer(cfg Config) retryer {
+	retries := cfg.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	baseDelay := cfg.RetryBaseDelay
+	if baseDelay <= 0 {
+		baseDelay = DefaultRetryBaseDelay
+	}
+	maxDelay := cfg.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryMaxDelay
+	}
+	if maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+	return retryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: retries},
+		bucket:         cfg.Bucket,
+		baseDelay:      baseDelay,
+		maxDelay:       maxDelay,
+	}
+}
+
+// RetryRules returns the delay before the request is retried.
+func (r retryer) RetryRules(req *request.Request) time.Duration {
+	op := "unknown"
+	if req.Operation != nil {
+		op = req.Operation.Name
+	}
+	retriesTotal.WithLabelValues(r.bucket, op).Inc()
+	return backoff(req.RetryCount, r.baseDelay, r.maxDelay)
+}
+
+// backoff returns the delay before a retry. The delay doubles with each
+// attempt up to maxDelay. A random half of it is dropped so that clients
+// which failed together do not retry together.
+func backoff(attempt int, baseDelay, maxDelay time.Duration) time.Duration {
+	delay := maxDelay
+	if attempt < 32 {
+		if d := baseDelay << uint(attempt); d > 0 && d < maxDelay {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
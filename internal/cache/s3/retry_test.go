@@ -0,0 +1,40 @@
+package s3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	base := 10 * time.Millisecond
+	max := time.Second
+	for attempt := 0; attempt < 70; attempt++ {
+		want := max
+		if attempt < 7 {
+			want = base << uint(attempt)
+		}
+		for i := 0; i < 10; i++ {
+			have := backoff(attempt, base, max)
+			if have < want/2 || have > want {
+				t.Fatalf("expected attempt %d to wait between %s and %s, got %s", attempt, want/2, want, have)
+			}
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		retries int
+		want    int
+	}{
+		{0, DefaultRetries},
+		{5, 5},
+		{-1, 0},
+	}
+	for _, test := range tests {
+		have := newRetryer(Config{Retries: test.retries}).MaxRetries()
+		if have != test.want {
+			t.Errorf("expected %d retries to allow %d, got %d", test.retries, test.want, have)
+		}
+	}
+}
@@ -2,13 +2,20 @@ package s3
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
-	"regexp"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -16,106 +23,263 @@ import (
 	"github.com/zenreach/hatchet"
 	"github.com/zenreach/hydroponics/internal/cache"
 	"github.com/zenreach/hydroponics/internal/pipes"
+	"github.com/zenreach/hydroponics/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+const (
+	// metaRefreshed holds the time at which the object was last refreshed.
+	metaRefreshed = "refreshed"
+
+	// metaContentLength holds the decoded length of the object.
+	metaContentLength = "decoded-length"
+)
+
+// DefaultBufferSize is the default number of downloaded bytes buffered for
+// each Get while waiting to be read. It allows each download worker to hold
+// two parts in the buffer.
+const DefaultBufferSize = 2 * s3manager.DefaultDownloadConcurrency * s3manager.DefaultDownloadPartSize
+
+// Config configures an S3 cache.
+type Config struct {
+	// Bucket is the name of the bucket to store objects in.
+	Bucket string
+
+	// Prefix is prepended to the key of each object. A trailing slash is
+	// appended if one does not exist.
+	Prefix string
+
+	// Namespace names the cache in circuit breaker metrics so that caches
+	// sharing a bucket are told apart.
+	Namespace string
+
+	// BufferSize is the maximum number of downloaded bytes held in memory for
+	// each Get. Downloads pause while the reader falls behind. Defaults to
+	// DefaultBufferSize.
+	BufferSize int
+
+	// Endpoint is the URL of an S3 compatible service such as MinIO or Ceph
+	// RGW. Defaults to AWS S3.
+	Endpoint string
+
+	// Region is the region of the bucket. Defaults to the region configured
+	// in the environment.
+	Region string
+
+	// PathStyle addresses the bucket in the URL path rather than the host
+	// name. Most S3 compatible services require it.
+	PathStyle bool
+
+	// CAFile is a PEM file of certificate authorities used to verify the
+	// endpoint. Defaults to the system roots.
+	CAFile string
+
+	// InsecureSkipVerify disables verification of the endpoint's TLS
+	// certificate.
+	InsecureSkipVerify bool
+
+	// ShardDepth is the number of two character shard directories placed
+	// before each object key, such as ab/cd/abcdef... for a depth of two. It
+	// spreads objects across S3 partitions for high request rates. Changing
+	// it orphans the objects already stored. Defaults to 0 (disabled).
+	ShardDepth int
+
+	// RefreshAge is the age after which an object is refreshed when it is
+	// read. Objects refreshed more recently are not copied. Defaults to
+	// DefaultRefreshAge.
+	RefreshAge time.Duration
+
+	// RefreshConcurrency is the number of objects refreshed at once.
+	// Defaults to DefaultRefreshConcurrency.
+	RefreshConcurrency int
+
+	// RefreshRate is the maximum number of objects refreshed per second.
+	// Defaults to DefaultRefreshRate.
+	RefreshRate float64
+
+	// Retries is the number of times a failed S3 request is retried. A
+	// negative value disables retries. Defaults to DefaultRetries.
+	Retries int
+
+	// RetryBaseDelay is the delay before the first retry. It doubles with
+	// each retry and is jittered. Defaults to DefaultRetryBaseDelay.
+	RetryBaseDelay time.Duration
+
+	// RetryMaxDelay is the maximum delay between retries. Defaults to
+	// DefaultRetryMaxDelay.
+	RetryMaxDelay time.Duration
+
+	// BreakerThreshold is the number of consecutive failed S3 requests which
+	// open the circuit breaker. A negative value disables the breaker.
+	// Defaults to DefaultBreakerThreshold.
+	BreakerThreshold int
+
+	// BreakerCooldown is the time the circuit breaker stays open before S3 is
+	// probed. Defaults to DefaultBreakerCooldown.
+	BreakerCooldown time.Duration
+}
+
 // Cache implements a cache backed by AWS S3.
 type Cache struct {
 	client     *s3.S3
 	uploader   *s3manager.Uploader
 	downloader *s3manager.Downloader
-	clean      *regexp.Regexp
 	bucket     string
+	namespace  string
 	prefix     string
+	shardDepth int
+	bufferSize int
+	refresher  *refresher
+	breaker    *breaker
 	logger     hatchet.Logger
 	shutdown   chan struct{}
 	wg         sync.WaitGroup
 }
 
-// New returns a new S3 cache which stores objects in the bucket with the given
-// key prefix. A trailing slash is appended if one does not exist.
+// New returns a new S3 cache which stores objects in the configured bucket
+// with the configured key prefix.
 //
-// The Get and Put methods sanitize the key value. Only alpahnumerics,
-// underscores, and dashes are allowed. All other characters are replaced by
-// underscores. Ensure keys match this pattern in order to avoid collisions due
-// to the sanitization.
-func New(bucket, prefix string, logger hatchet.Logger) (*Cache, error) {
-	sesh, err := session.NewSession()
+// Keys are encoded so that any key may be stored without colliding with
+// another. Letters, digits, and dashes are kept and every other byte is
+// escaped. Hex digests are stored unchanged.
+//
+// Failed requests are retried with backoff. After sustained failures the
+// circuit breaker opens and the cache fails fast: reads miss and writes are
+// dropped until S3 recovers.
+func New(cfg Config, logger hatchet.Logger) (*Cache, error) {
+	if cfg.ShardDepth < 0 || cfg.ShardDepth > MaxShardDepth {
+		return nil, fmt.Errorf("shard depth must be between 0 and %d", MaxShardDepth)
+	}
+	awsCfg, err := awsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sesh, err := session.NewSession(awsCfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "aws client")
 	}
 
+	prefix := cfg.Prefix
 	l := len(prefix)
 	if l > 0 && prefix[l-1:] != "/" {
 		prefix = fmt.Sprintf("%s/", prefix)
 	}
 
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
 	client := s3.New(sesh)
-	return &Cache{
+	c := &Cache{
 		client:     client,
 		uploader:   s3manager.NewUploaderWithClient(client),
 		downloader: s3manager.NewDownloaderWithClient(client),
-		clean:      regexp.MustCompile(`[^a-zA-Z0-9_-]`),
-		bucket:     bucket,
+		bucket:     cfg.Bucket,
+		namespace:  cfg.Namespace,
 		prefix:     prefix,
+		shardDepth: cfg.ShardDepth,
+		bufferSize: bufferSize,
+		breaker:    newBreaker(cfg),
 		logger:     logger,
 		shutdown:   make(chan struct{}),
-	}, nil
+	}
+	c.refresher = newRefresher(c, cfg)
+	return c, nil
 }
 
-func (c *Cache) realKey(key string) string {
-	key = c.clean.ReplaceAllString(key, "_")
-	if c.prefix != "" {
-		key = fmt.Sprintf("%s%s", c.prefix, key)
+// awsConfig returns the AWS client configuration for the cache.
+func awsConfig(cfg Config) (*aws.Config, error) {
+	awsCfg := request.WithRetryer(aws.NewConfig(), newRetryer(cfg))
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint)
+	}
+	if cfg.Region != "" {
+		awsCfg = awsCfg.WithRegion(cfg.Region)
+	}
+	if cfg.PathStyle {
+		awsCfg = awsCfg.WithS3ForcePathStyle(true)
+	}
+	if cfg.CAFile == "" && !cfg.InsecureSkipVerify {
+		return awsCfg, nil
 	}
-	return key
+
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca file")
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return awsCfg.WithHTTPClient(&http.Client{Transport: transport}), nil
+}
+
+// realKey returns the object key of a cache key.
+func (c *Cache) realKey(key string) string {
+	return c.prefix + shard(key, c.shardDepth) + encodeKey(key)
 }
 
 func (c *Cache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
 	realKey := c.realKey(key)
+	ctx, span := tracing.Start(ctx, "s3.Get", c.spanAttributes(realKey)...)
 
 	// check if the object exists
-	_, err := c.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-		Bucket: sp(c.bucket),
-		Key:    sp(realKey),
-	})
-	if isErrCode(err, 404) {
-		return nil, cache.ErrCacheMiss
-	} else if err != nil {
-		fmt.Printf("%#v\n", err)
-		if err == ctx.Err() {
-			return nil, err
-		}
-		return nil, errors.Wrap(err, "aws client")
+	info, refreshed, err := c.stat(ctx, key)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
 	}
 
 	c.wg.Add(2)
 
-	// create a new context for the downloader that will be cancelled on shutdown
-	var downloadCtx context.Context
-	var downloadCancel context.CancelFunc
-	if deadline, ok := ctx.Deadline(); ok {
-		downloadCtx, downloadCancel = context.WithDeadline(context.Background(), deadline)
-	} else {
-		downloadCtx, downloadCancel = context.WithCancel(context.Background())
-	}
+	// download the object concurrently; the bounded pipe pauses the download
+	// workers while the reader falls behind
+	pipe := pipes.NewBoundedBlocks(c.bufferSize)
+	finished := make(chan struct{})
 
+	// the download is cancelled with the request, when the reader is closed,
+	// or on shutdown
+	downloadCtx, downloadCancel := context.WithCancel(ctx)
 	go func() {
+		defer c.wg.Done()
 		select {
-		case <-c.shutdown:
+		case <-finished:
 			downloadCancel()
+			return
+		case <-c.shutdown:
 		case <-downloadCtx.Done():
 		}
-		c.wg.Done()
+		downloadCancel()
+		select {
+		case <-finished:
+		default:
+			// release download workers waiting for the reader
+			pipe.CloseWithError(downloadCtx.Err())
+		}
 	}()
 
-	// download the object concurrently
-	pipe := pipes.NewBlocks()
+	inFlight := downloadsInFlight.WithLabelValues(c.bucket)
+	inFlight.Inc()
+	_, downloadSpan := tracing.Start(ctx, "s3.Download", c.spanAttributes(realKey)...)
 	go func() {
-		defer downloadCancel()
+		defer close(finished)
+		defer inFlight.Dec()
+		start := time.Now()
 		_, err := c.downloader.DownloadWithContext(downloadCtx, pipe, &s3.GetObjectInput{
 			Bucket: sp(c.bucket),
 			Key:    sp(realKey),
 		})
+		c.observe(opGet, start, err)
+		c.record(downloadCtx, err)
+		tracing.End(downloadSpan, err)
 		if err == nil {
 			pipe.Close()
 		} else {
@@ -123,24 +287,146 @@ func (c *Cache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
 		}
 		c.wg.Done()
 	}()
-	c.touch(key)
-	return &nopCloser{pipe}, nil
+	c.refresher.add(ctx, key, info.Metadata, refreshed)
+	span.End()
+	return &download{
+		BlockPipe: pipe,
+		cancel:    downloadCancel,
+		meta:      info.Metadata,
+	}, nil
 }
 
-func (c *Cache) Put(ctx context.Context, key string, data io.Reader) error {
-	_, err := c.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+// GetRange downloads the range with a single ranged request. A range which
+// starts past the end of the object is read as empty.
+func (c *Cache) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	realKey := c.realKey(key)
+	if !c.breaker.allow() {
+		c.reject(opGetRange)
+		return nil, cache.ErrUnavailable
+	}
+	ctx, span := tracing.Start(ctx, "s3.GetRange", c.spanAttributes(realKey)...)
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	start := time.Now()
+	res, err := c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: sp(c.bucket),
-		Key:    sp(c.realKey(key)),
-		Body:   data,
+		Key:    sp(realKey),
+		Range:  sp(byteRange),
 	})
+	if isErrCode(err, 416) {
+		c.observe(opGetRange, start, nil)
+		c.record(ctx, nil)
+		tracing.End(span, nil)
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	c.observe(opGetRange, start, err)
+	c.record(ctx, err)
+	if isErrCode(err, 404) {
+		tracing.End(span, cache.ErrCacheMiss)
+		return nil, cache.ErrCacheMiss
+	}
+	tracing.End(span, err)
+	if err != nil {
+		if err == ctx.Err() {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "aws client")
+	}
+
+	var lastModified time.Time
+	if res.LastModified != nil {
+		lastModified = *res.LastModified
+	}
+	meta := objectInfoMetadata(res.ContentEncoding, res.Metadata)
+	c.refresher.add(ctx, key, meta, refreshedAt(res.Metadata, lastModified))
+	return &rangeDownload{
+		ReadCloser: cache.LimitReadCloser(res.Body, length),
+		meta:       meta,
+	}, nil
+}
+
+func (c *Cache) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	info, _, err := c.stat(ctx, key)
+	return info, err
+}
+
+// stat returns the object's info and the time at which it was last
+// refreshed.
+func (c *Cache) stat(ctx context.Context, key string) (*cache.Info, time.Time, error) {
+	realKey := c.realKey(key)
+	if !c.breaker.allow() {
+		c.reject(opHead)
+		return nil, time.Time{}, cache.ErrUnavailable
+	}
+	ctx, span := tracing.Start(ctx, "s3.Head", c.spanAttributes(realKey)...)
+	start := time.Now()
+	res, err := c.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: sp(c.bucket),
+		Key:    sp(realKey),
+	})
+	c.observe(opHead, start, err)
+	c.record(ctx, err)
+	if isErrCode(err, 404) {
+		tracing.End(span, cache.ErrCacheMiss)
+	} else {
+		tracing.End(span, err)
+	}
+	if isErrCode(err, 404) {
+		return nil, time.Time{}, cache.ErrCacheMiss
+	} else if err != nil {
+		if err == ctx.Err() {
+			return nil, time.Time{}, err
+		}
+		return nil, time.Time{}, errors.Wrap(err, "aws client")
+	}
+
+	info := &cache.Info{
+		Metadata: objectInfoMetadata(res.ContentEncoding, res.Metadata),
+	}
+	if res.ContentLength != nil {
+		info.Size = *res.ContentLength
+	}
+	if res.LastModified != nil {
+		info.LastModified = *res.LastModified
+	}
+	return info, refreshedAt(res.Metadata, info.LastModified), nil
+}
+
+func (c *Cache) Put(ctx context.Context, key string, data io.Reader, meta cache.Metadata) error {
+	realKey := c.realKey(key)
+	if !c.breaker.allow() {
+		// read the object so that other tiers being written receive it
+		c.reject(opUpload)
+		c.logDebug(realKey, "", "drop put while s3 is unavailable")
+		_, err := io.Copy(ioutil.Discard, data)
+		return err
+	}
+	ctx, span := tracing.Start(ctx, "s3.Put", c.spanAttributes(realKey)...)
+	start := time.Now()
+	_, err := c.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:          sp(c.bucket),
+		Key:             sp(realKey),
+		Body:            data,
+		ContentEncoding: contentEncoding(meta),
+		Metadata:        objectMetadata(meta),
+	})
+	c.observe(opUpload, start, err)
+	c.record(ctx, err)
+	tracing.End(span, err)
 	if err == ctx.Err() {
 		return err
 	}
 	return errors.Wrap(err, "aws client")
 }
 
+// Shutdown aborts downloads in progress and finishes the queued refreshes.
+// If the context expires first then the remaining refreshes are abandoned and
+// ctx.Err() is returned.
 func (c *Cache) Shutdown(ctx context.Context) error {
 	close(c.shutdown)
+	c.refresher.close()
 	ch := make(chan struct{})
 	go func() {
 		c.wg.Wait()
@@ -150,32 +436,47 @@ func (c *Cache) Shutdown(ctx context.Context) error {
 	select {
 	case <-ch:
 	case <-ctx.Done():
+		c.refresher.cancel()
 		return ctx.Err()
 	}
-	return nil
+	return c.refresher.wait(ctx)
 }
 
-func (c *Cache) touch(key string) {
-	c.wg.Add(1)
-	go func() {
-		defer c.wg.Done()
-		realKey := c.realKey(key)
-		source := fmt.Sprintf("/%s/%s", c.bucket, realKey)
-		_, err := c.client.CopyObject(&s3.CopyObjectInput{
-			Bucket:     sp(c.bucket),
-			Key:        sp(realKey),
-			CopySource: sp(source),
-			Metadata: map[string]*string{
-				"refreshed": sp(fmt.Sprintf("%d", time.Now().UTC().Unix())),
-			},
-			MetadataDirective: sp("REPLACE"),
-		})
-		if err == nil {
-			c.logDebug(realKey, source, "refresh key")
-		} else {
-			c.logError(err, realKey, source, "key refresh error")
+// record reports the outcome of an S3 request to the circuit breaker. A miss
+// is a success. Requests cancelled by the client and uploads which failed to
+// read their data are not the fault of S3 and have no outcome.
+func (c *Cache) record(ctx context.Context, err error) {
+	switch {
+	case err == nil || isErrCode(err, 404):
+		if c.breaker.success() {
+			breakerOpen.WithLabelValues(c.bucket, c.namespace).Set(0)
+			c.logger.Log(hatchet.L{
+				"message": "s3 circuit breaker closed",
+				"bucket":  c.bucket,
+				"level":   "info",
+			})
 		}
-	}()
+	case ctx.Err() == context.Canceled || isReadError(err):
+		c.breaker.abandon()
+	default:
+		if c.breaker.failure() {
+			breakerOpen.WithLabelValues(c.bucket, c.namespace).Set(1)
+			c.logger.Log(hatchet.L{
+				"message": "s3 circuit breaker opened",
+				"bucket":  c.bucket,
+				"level":   "error",
+				"error":   err,
+			})
+		}
+	}
+}
+
+// spanAttributes returns the trace attributes of an operation on an object.
+func (c *Cache) spanAttributes(realKey string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("s3.bucket", c.bucket),
+		attribute.String("s3.key", realKey),
+	}
 }
 
 func (c *Cache) logError(err error, key, source, msg string) {
@@ -199,10 +500,64 @@ func (c *Cache) logDebug(key, source, msg string) {
 	})
 }
 
+// contentEncoding returns the S3 content encoding of an object with the given
+// metadata. Nil is returned if the object is not encoded.
+func contentEncoding(meta cache.Metadata) *string {
+	if meta.ContentEncoding == "" {
+		return nil
+	}
+	return sp(meta.ContentEncoding)
+}
+
+// objectMetadata returns the S3 user metadata for an object with the given
+// metadata.
+func objectMetadata(meta cache.Metadata) map[string]*string {
+	metadata := make(map[string]*string)
+	if meta.ContentLength >= 0 {
+		metadata[metaContentLength] = sp(strconv.FormatInt(meta.ContentLength, 10))
+	}
+	return metadata
+}
+
+// objectInfoMetadata returns the cache metadata of an object with the given S3
+// content encoding and user metadata.
+func objectInfoMetadata(encoding *string, metadata map[string]*string) cache.Metadata {
+	meta := cache.Metadata{
+		ContentLength: -1,
+	}
+	if encoding != nil {
+		meta.ContentEncoding = *encoding
+	}
+	if length, ok := getMetadata(metadata, metaContentLength); ok {
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err == nil {
+			meta.ContentLength = n
+		}
+	}
+	return meta
+}
+
+// getMetadata returns the value of an S3 user metadata key. Keys are matched
+// case insensitively as S3 does not preserve their case.
+func getMetadata(metadata map[string]*string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v, true
+		}
+	}
+	return "", false
+}
+
 func sp(s string) *string {
 	return &s
 }
 
+// isReadError returns true if an upload failed to read its data.
+func isReadError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "ReadRequestBody"
+}
+
 func isErrCode(err error, code int) bool {
 	awsErr, ok := err.(awserr.RequestFailure)
 	if !ok {
@@ -0,0 +1,242 @@
+package s3_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/s3"
+)
+
+const (
+	testBucket = "test-bucket"
+	testRegion = "us-east-1"
+)
+
+func TestMain(m *testing.M) {
+	// the fake server accepts any credentials
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	os.Exit(m.Run())
+}
+
+// startS3 runs a fake S3 server with an empty test bucket. It returns the
+// endpoint of the server.
+func startS3(t *testing.T) string {
+	server := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	t.Cleanup(server.Close)
+
+	sesh, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion(testRegion).
+		WithS3ForcePathStyle(true))
+	if err != nil {
+		t.Fatalf("failed to create session: %s", err)
+	}
+	_, err = awss3.New(sesh).CreateBucket(&awss3.CreateBucketInput{
+		Bucket: aws.String(testBucket),
+	})
+	if err != nil {
+		t.Fatalf("failed to create bucket: %s", err)
+	}
+	return server.URL
+}
+
+// newCache returns a cache in the test bucket which is shut down when the test
+// completes.
+func newCache(t *testing.T, cfg s3.Config) *s3.Cache {
+	cfg.Bucket = testBucket
+	cfg.Region = testRegion
+	cfg.PathStyle = true
+	c, err := s3.New(cfg, hatchet.Test(t))
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := c.Shutdown(ctx); err != nil {
+			t.Errorf("failed to shutdown cache: %s", err)
+		}
+	})
+	return c
+}
+
+func TestCommon(t *testing.T) {
+	endpoint := startS3(t)
+
+	var count int64
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		// give each test its own prefix as they share a bucket
+		return newCache(t, s3.Config{
+			Prefix:   fmt.Sprintf("test%d", atomic.AddInt64(&count, 1)),
+			Endpoint: endpoint,
+		})
+	})
+}
+
+func TestSharded(t *testing.T) {
+	endpoint := startS3(t)
+
+	var count int64
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		return newCache(t, s3.Config{
+			Prefix:     fmt.Sprintf("sharded%d", atomic.AddInt64(&count, 1)),
+			Endpoint:   endpoint,
+			ShardDepth: 2,
+		})
+	})
+}
+
+func TestKeyEncoding(t *testing.T) {
+	endpoint := startS3(t)
+	c := newCache(t, s3.Config{
+		Prefix:   "encoding",
+		Endpoint: endpoint,
+	})
+
+	// these keys collide if unsafe characters are replaced
+	keys := []string{"a/b", "a.b", "a_b", "a_2fb", "a b"}
+	for _, key := range keys {
+		cachetest.AssertPut(t, c, key, []byte(key))
+	}
+	for _, key := range keys {
+		cachetest.AssertGet(t, c, key, []byte(key))
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	endpoint := startS3(t)
+	key := "abcdef0123456789"
+	tests := []struct {
+		depth int
+		want  string
+	}{
+		{0, "layout0/abcdef0123456789"},
+		{2, "layout2/ab/cd/abcdef0123456789"},
+	}
+	for _, test := range tests {
+		c := newCache(t, s3.Config{
+			Prefix:     fmt.Sprintf("layout%d", test.depth),
+			Endpoint:   endpoint,
+			ShardDepth: test.depth,
+		})
+		cachetest.AssertPut(t, c, key, []byte("value"))
+
+		sesh, err := session.NewSession(aws.NewConfig().
+			WithEndpoint(endpoint).
+			WithRegion(testRegion).
+			WithS3ForcePathStyle(true))
+		if err != nil {
+			t.Fatalf("failed to create session: %s", err)
+		}
+		_, err = awss3.New(sesh).HeadObject(&awss3.HeadObjectInput{
+			Bucket: aws.String(testBucket),
+			Key:    aws.String(test.want),
+		})
+		if err != nil {
+			t.Errorf("expected object %s: %s", test.want, err)
+		}
+	}
+}
+
+// refreshed returns true if the object has been refreshed.
+func refreshed(t *testing.T, endpoint, realKey string) bool {
+	sesh, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(endpoint).
+		WithRegion(testRegion).
+		WithS3ForcePathStyle(true))
+	if err != nil {
+		t.Fatalf("failed to create session: %s", err)
+	}
+	res, err := awss3.New(sesh).HeadObject(&awss3.HeadObjectInput{
+		Bucket: aws.String(testBucket),
+		Key:    aws.String(realKey),
+	})
+	if err != nil {
+		t.Fatalf("failed to head object: %s", err)
+	}
+	for k := range res.Metadata {
+		if strings.EqualFold(k, "refreshed") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRefresh(t *testing.T) {
+	endpoint := startS3(t)
+	tests := []struct {
+		name string
+		age  time.Duration
+		want bool
+	}{
+		// objects are refreshed once they are older than the refresh age
+		{"stale", time.Nanosecond, true},
+		{"fresh", time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := s3.New(s3.Config{
+				Bucket:     testBucket,
+				Prefix:     "refresh-" + test.name,
+				Endpoint:   endpoint,
+				Region:     testRegion,
+				PathStyle:  true,
+				RefreshAge: test.age,
+			}, hatchet.Test(t))
+			if err != nil {
+				t.Fatalf("failed to create cache: %s", err)
+			}
+
+			key := "abcdef0123456789"
+			cachetest.AssertPut(t, c, key, []byte("value"))
+			for i := 0; i < 3; i++ {
+				cachetest.AssertGet(t, c, key, []byte("value"))
+			}
+
+			// shutdown finishes the queued refreshes
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			if err := c.Shutdown(ctx); err != nil {
+				t.Fatalf("failed to shutdown cache: %s", err)
+			}
+			if have := refreshed(t, endpoint, "refresh-"+test.name+"/"+key); have != test.want {
+				t.Errorf("expected refreshed %t, got %t", test.want, have)
+			}
+		})
+	}
+}
+
+func TestShardDepth(t *testing.T) {
+	_, err := s3.New(s3.Config{
+		Bucket:     testBucket,
+		ShardDepth: s3.MaxShardDepth + 1,
+	}, hatchet.Test(t))
+	if err == nil {
+		t.Error("expected an error for an invalid shard depth")
+	}
+}
+
+func TestCAFile(t *testing.T) {
+	_, err := s3.New(s3.Config{
+		Bucket: testBucket,
+		CAFile: "does-not-exist.pem",
+	}, hatchet.Test(t))
+	if err == nil {
+		t.Error("expected an error for a missing ca file")
+	}
+}
@@ -0,0 +1,227 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zenreach/hydroponics/internal/cache"
+)
+
+const (
+	// journalDir holds the spooled objects waiting to be uploaded.
+	journalDir = "journal"
+
+	// tmpDir holds objects which are being spooled.
+	tmpDir = "tmp"
+
+	// maxHeaderSize is the maximum size of an entry header.
+	maxHeaderSize = 64 * 1024
+
+	// entrySuffix ends the name of each journal entry.
+	entrySuffix = ".entry"
+)
+
+// entry is a spooled object waiting to be uploaded. Each entry is a file in
+// the journal directory which holds a header followed by the object data.
+// Entries are named after the time they were spooled so that they are
+// replayed in order.
+type entry struct {
+	key  string
+	meta cache.Metadata
+	path string
+	size int64 // size of the entry file
+}
+
+// header is written at the start of each entry file.
+type header struct {
+	Key             string `json:"key"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	ContentLength   int64  `json:"content_length"`
+}
+
+// writeEntry spools the object to a temporary file which is synced and then
+// renamed into the journal. The object is durable once writeEntry returns.
+func writeEntry(dir string, seq uint64, key string, rdr io.Reader, meta cache.Metadata) (*entry, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(dir, tmpDir), "put-")
+	if err != nil {
+		return nil, errors.Wrap(err, "spool")
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := writeObject(tmp, key, rdr, meta)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, errors.Wrap(closeErr, "spool")
+	}
+
+	name := fmt.Sprintf("%020d-%010d%s", time.Now().UnixNano(), seq, entrySuffix)
+	path := filepath.Join(dir, journalDir, name)
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return nil, errors.Wrap(err, "spool")
+	}
+	err = syncDir(filepath.Join(dir, journalDir))
+	if err != nil {
+		os.Remove(path)
+		return nil, errors.Wrap(err, "spool")
+	}
+	return &entry{
+		key:  key,
+		meta: meta,
+		path: path,
+		size: size,
+	}, nil
+}
+
+// readEntries returns the entries in the journal in the order they were
+// spooled. Entries which cannot be read are removed.
+func readEntries(dir string) ([]*entry, error) {
+	root := filepath.Join(dir, journalDir)
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	var entries []*entry
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), entrySuffix) {
+			continue
+		}
+		path := filepath.Join(root, info.Name())
+		e, err := readEntry(path)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readEntry reads the header of an entry file.
+func readEntry(path string) (*entry, error) {
+	file, hdr, err := openEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &entry{
+		key: hdr.Key,
+		meta: cache.Metadata{
+			ContentEncoding: hdr.ContentEncoding,
+			ContentLength:   hdr.ContentLength,
+		},
+		path: path,
+		size: hdr.fileSize,
+	}, nil
+}
+
+// entryHeader is a header read from an entry file.
+type entryHeader struct {
+	header
+	size     int64 // size of the object data following the header
+	fileSize int64
+	modified time.Time
+}
+
+// openEntry opens the entry file and reads its header. The returned file is
+// positioned at the start of the object data.
+func openEntry(path string) (*os.File, *entryHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr, err := readHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, hdr, nil
+}
+
+// writeObject writes the header and object data to the file. Returns the
+// total number of bytes written.
+func writeObject(file *os.File, key string, rdr io.Reader, meta cache.Metadata) (int64, error) {
+	data, err := json.Marshal(&header{
+		Key:             key,
+		ContentEncoding: meta.ContentEncoding,
+		ContentLength:   meta.ContentLength,
+	})
+	if err != nil {
+		return 0, err
+	}
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(len(data)))
+	_, err = file.Write(append(prefix, data...))
+	if err != nil {
+		return 0, errors.Wrap(err, "spool")
+	}
+
+	n, err := io.Copy(file, rdr)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(prefix)+len(data)) + n, nil
+}
+
+// readHeader reads the header from the start of an entry file.
+func readHeader(file *os.File) (*entryHeader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 4)
+	_, err = io.ReadFull(file, prefix)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix)
+	if length > maxHeaderSize {
+		return nil, errors.New("invalid entry header")
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &entryHeader{
+		size:     info.Size() - int64(len(prefix)) - int64(length),
+		fileSize: info.Size(),
+		modified: info.ModTime(),
+	}
+	err = json.Unmarshal(data, &hdr.header)
+	if err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// syncDir flushes a directory so that the entries renamed into it survive a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
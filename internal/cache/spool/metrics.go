@@ -0,0 +1,38 @@
+package spool
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results of an upload recorded in metrics.
+const (
+	resultOK    = "ok"
+	resultError = "error"
+	// resultDirect is a put written to the wrapped cache as the spool was
+	// full.
+	resultDirect = "direct"
+)
+
+var (
+	pendingUploads = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hydroponics",
+		Subsystem: "spool",
+		Name:      "pending_uploads",
+		Help:      "Number of spooled objects waiting to be uploaded.",
+	})
+
+	pendingBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hydroponics",
+		Subsystem: "spool",
+		Name:      "pending_bytes",
+		Help:      "Bytes of spooled objects waiting to be uploaded.",
+	})
+
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hydroponics",
+		Subsystem: "spool",
+		Name:      "uploads_total",
+		Help:      "Uploads of spooled objects by result.",
+	}, []string{"result"})
+)
@@ -0,0 +1,447 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/cache"
+)
+
+const (
+	// DefaultConcurrency is the default number of spooled objects uploaded
+	// at once.
+	DefaultConcurrency = 4
+
+	// DefaultMaxSize is the default number of bytes which may be spooled.
+	DefaultMaxSize = 10 * 1024 * 1024 * 1024
+
+	// DefaultRetryDelay is the default time before a failed upload is
+	// retried.
+	DefaultRetryDelay = 10 * time.Second
+)
+
+// Config configures a spool.
+type Config struct {
+	// Dir is the directory which holds the spooled objects. It is created if
+	// it does not exist.
+	Dir string
+
+	// Concurrency is the number of spooled objects uploaded at once.
+	// Defaults to DefaultConcurrency.
+	Concurrency int
+
+	// MaxSize is the number of bytes which may be spooled. Puts are written
+	// directly to the wrapped cache while the spool is full. Defaults to
+	// DefaultMaxSize.
+	MaxSize int64
+
+	// RetryDelay is the time before a failed upload is retried. Defaults to
+	// DefaultRetryDelay.
+	RetryDelay time.Duration
+}
+
+// Cache writes objects behind a slower cache. A Put returns once the object is
+// durably spooled to the local disk. A pool of workers uploads the spooled
+// objects to the wrapped cache in the background. Spooled objects are served
+// by Get and Stat until they are uploaded.
+//
+// The spool directory is a journal of the objects waiting to be uploaded.
+// Objects left in the journal when the process exits are uploaded when the
+// spool is next created.
+type Cache struct {
+	cache      cache.Cache
+	dir        string
+	maxSize    int64
+	retryDelay time.Duration
+	logger     hatchet.Logger
+	wg         sync.WaitGroup
+
+	// ctx aborts uploads in progress when shutdown times out
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	seq       uint64
+	queue     []*entry
+	pending   map[string]*entry // latest entry of each key
+	uploading map[string]bool
+	retrying  int // failed entries waiting to be queued again
+	size      int64
+	closed    bool
+}
+
+// New returns a spool in front of the backend cache. Objects spooled by a
+// previous process are queued for upload.
+func New(backend cache.Cache, cfg Config, logger hatchet.Logger) (*Cache, error) {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	retryDelay := cfg.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = DefaultRetryDelay
+	}
+
+	// discard objects which were not completely spooled
+	err := os.RemoveAll(filepath.Join(cfg.Dir, tmpDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "spool")
+	}
+	for _, name := range []string{journalDir, tmpDir} {
+		err = os.MkdirAll(filepath.Join(cfg.Dir, name), 0755)
+		if err != nil {
+			return nil, errors.Wrap(err, "spool")
+		}
+	}
+	entries, err := readEntries(cfg.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "spool")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cache{
+		cache:      backend,
+		dir:        cfg.Dir,
+		maxSize:    maxSize,
+		retryDelay: retryDelay,
+		logger:     logger,
+		ctx:        ctx,
+		cancel:     cancel,
+		pending:    make(map[string]*entry),
+		uploading:  make(map[string]bool),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	for _, e := range entries {
+		c.add(e)
+	}
+	if len(entries) > 0 {
+		logger.Log(hatchet.L{
+			"message": "replay spooled uploads",
+			"level":   "info",
+			"dir":     c.dir,
+			"count":   len(entries),
+		})
+	}
+
+	c.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go c.work()
+	}
+	return c, nil
+}
+
+func (c *Cache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, hdr, ok := c.open(key)
+	if !ok {
+		return c.cache.Get(ctx, key)
+	}
+	return &object{
+		Reader: io.LimitReader(file, hdr.size),
+		file:   file,
+		meta: cache.Metadata{
+			ContentEncoding: hdr.ContentEncoding,
+			ContentLength:   hdr.ContentLength,
+		},
+	}, nil
+}
+
+func (c *Cache) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	file, hdr, ok := c.open(key)
+	if !ok {
+		return cache.GetRange(ctx, c.cache, key, offset, length)
+	}
+	if offset > hdr.size {
+		offset = hdr.size
+	}
+	_, err := file.Seek(offset, io.SeekCurrent)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "spool")
+	}
+	size := hdr.size - offset
+	if length >= 0 && length < size {
+		size = length
+	}
+	return &object{
+		Reader: io.LimitReader(file, size),
+		file:   file,
+		meta: cache.Metadata{
+			ContentEncoding: hdr.ContentEncoding,
+			ContentLength:   hdr.ContentLength,
+		},
+	}, nil
+}
+
+func (c *Cache) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	file, hdr, ok := c.open(key)
+	if !ok {
+		return c.cache.Stat(ctx, key)
+	}
+	file.Close()
+	return &cache.Info{
+		Metadata: cache.Metadata{
+			ContentEncoding: hdr.ContentEncoding,
+			ContentLength:   hdr.ContentLength,
+		},
+		Size:         hdr.size,
+		LastModified: hdr.modified,
+	}, nil
+}
+
+// Put spools the object and queues it for upload. The object is written
+// directly to the wrapped cache if the spool is full or shut down. A direct
+// write waits for the upload of an older object of the same key so that it
+// is not replaced by it.
+func (c *Cache) Put(ctx context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
+	c.mu.Lock()
+	direct := c.closed || c.size >= c.maxSize
+	if direct {
+		// an older spooled object must not replace this one
+		delete(c.pending, key)
+		for c.uploading[key] {
+			c.cond.Wait()
+		}
+		c.uploading[key] = true
+	}
+	c.seq++
+	seq := c.seq
+	c.mu.Unlock()
+
+	if direct {
+		uploadsTotal.WithLabelValues(resultDirect).Inc()
+		err := c.cache.Put(ctx, key, rdr, meta)
+		c.mu.Lock()
+		delete(c.uploading, key)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		return err
+	}
+	e, err := writeEntry(c.dir, seq, key, rdr, meta)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.add(e)
+	c.mu.Unlock()
+	return nil
+}
+
+// Shutdown stops spooling and waits for the spooled objects to be uploaded.
+// If the context expires first then the uploads in progress are aborted and
+// ctx.Err() is returned. An error is also returned if any objects are left in
+// the journal. They are uploaded when the spool is next created.
+func (c *Cache) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.cancel()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		<-done
+		err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	left := len(c.pending)
+	c.mu.Unlock()
+	if left == 0 {
+		return err
+	}
+	c.logger.Log(hatchet.L{
+		"message": "spooled uploads left for next start",
+		"level":   "error",
+		"dir":     c.dir,
+		"count":   left,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "%d spooled uploads left in %s", left, c.dir)
+	}
+	return fmt.Errorf("%d spooled uploads left in %s", left, c.dir)
+}
+
+// open returns the spooled object of the key. False is returned if the key is
+// not spooled.
+func (c *Cache) open(key string) (*os.File, *entryHeader, bool) {
+	c.mu.Lock()
+	e := c.pending[key]
+	c.mu.Unlock()
+	if e == nil {
+		return nil, nil, false
+	}
+	file, hdr, err := openEntry(e.path)
+	if err != nil {
+		// uploaded and removed after the entry was found
+		return nil, nil, false
+	}
+	return file, hdr, true
+}
+
+// add queues an entry for upload. It replaces any older entry of the same
+// key. The caller must hold c.mu.
+func (c *Cache) add(e *entry) {
+	c.pending[e.key] = e
+	c.queue = append(c.queue, e)
+	c.size += e.size
+	pendingUploads.Inc()
+	pendingBytes.Add(float64(e.size))
+	c.cond.Broadcast()
+}
+
+// remove deletes an entry from the journal. The caller must hold c.mu.
+func (c *Cache) remove(e *entry) {
+	if c.pending[e.key] == e {
+		delete(c.pending, e.key)
+	}
+	os.Remove(e.path)
+	c.size -= e.size
+	pendingUploads.Dec()
+	pendingBytes.Sub(float64(e.size))
+}
+
+func (c *Cache) work() {
+	defer c.wg.Done()
+	for {
+		e := c.next()
+		if e == nil {
+			return
+		}
+		c.upload(e)
+	}
+}
+
+// next waits for an entry to upload. Entries which were replaced are removed.
+// An entry is not uploaded while another entry of the same key is being
+// uploaded so that the latest entry is stored last. Nil is returned once the
+// spool is shut down and no entries are queued or waiting to be retried, or
+// the uploads are aborted.
+func (c *Cache) next() *entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		for i := 0; i < len(c.queue); i++ {
+			e := c.queue[i]
+			if c.pending[e.key] != e {
+				c.queue = append(c.queue[:i], c.queue[i+1:]...)
+				c.remove(e)
+				i--
+				continue
+			}
+			if c.uploading[e.key] {
+				continue
+			}
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			c.uploading[e.key] = true
+			return e
+		}
+		if c.closed && len(c.queue) == 0 && c.retrying == 0 {
+			return nil
+		}
+		c.cond.Wait()
+	}
+}
+
+// upload copies an entry to the wrapped cache. It is removed from the journal
+// once it is stored. A failed upload is retried after the retry delay until
+// the uploads are aborted.
+func (c *Cache) upload(e *entry) {
+	file, hdr, err := openEntry(e.path)
+	if err != nil {
+		c.logError(err, e.key, "discard unreadable spooled object")
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.uploading, e.key)
+		c.cond.Broadcast()
+		c.remove(e)
+		return
+	}
+	err = c.cache.Put(c.ctx, e.key, io.LimitReader(file, hdr.size), e.meta)
+	file.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.uploading, e.key)
+	c.cond.Broadcast()
+	switch {
+	case err == nil:
+		uploadsTotal.WithLabelValues(resultOK).Inc()
+		c.logDebug(e.key, "upload spooled object")
+		c.remove(e)
+	case c.ctx.Err() != nil:
+		// aborted by shutdown; the entry is uploaded on the next start
+	default:
+		uploadsTotal.WithLabelValues(resultError).Inc()
+		c.logError(err, e.key, "spooled upload error")
+		c.retrying++
+		time.AfterFunc(c.retryDelay, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.retrying--
+			if c.ctx.Err() == nil {
+				c.queue = append(c.queue, e)
+			}
+			c.cond.Broadcast()
+		})
+	}
+}
+
+func (c *Cache) logDebug(key, msg string) {
+	c.logger.Log(hatchet.L{
+		"message": msg,
+		"key":     key,
+		"dir":     c.dir,
+		"level":   "debug",
+	})
+}
+
+func (c *Cache) logError(err error, key, msg string) {
+	c.logger.Log(hatchet.L{
+		"message": msg,
+		"key":     key,
+		"dir":     c.dir,
+		"level":   "error",
+		"error":   err,
+	})
+}
+
+// object is a reader of a spooled object's data.
+type object struct {
+	io.Reader
+	file *os.File
+	meta cache.Metadata
+}
+
+func (o *object) Metadata() cache.Metadata {
+	return o.meta
+}
+
+func (o *object) Close() error {
+	return o.file.Close()
+}
@@ -0,0 +1,238 @@
+package spool_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/memory"
+	"github.com/zenreach/hydroponics/internal/cache/spool"
+)
+
+// gatedCache is a memory cache whose puts wait for the gate to be opened or
+// their context to expire. The first failPuts puts fail.
+type gatedCache struct {
+	cache.Cache
+	gate     chan struct{}
+	puts     int32
+	failPuts int32
+}
+
+func newGatedCache() *gatedCache {
+	return &gatedCache{
+		Cache: memory.New(4*1024*1024, 4*1024*1024),
+		gate:  make(chan struct{}),
+	}
+}
+
+func (c *gatedCache) Put(ctx context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
+	n := atomic.AddInt32(&c.puts, 1)
+	select {
+	case <-c.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if n <= c.failPuts {
+		return errors.New("put failed")
+	}
+	return c.Cache.Put(ctx, key, rdr, meta)
+}
+
+// newSpool returns a spool which is shut down when the test completes.
+func newSpool(t *testing.T, backend cache.Cache, cfg spool.Config) *spool.Cache {
+	c, err := spool.New(backend, cfg, hatchet.Test(t))
+	if err != nil {
+		t.Fatalf("failed to create spool: %s", err)
+	}
+	t.Cleanup(func() {
+		shutdown(t, c, time.Second)
+	})
+	return c
+}
+
+func shutdown(t *testing.T, c *spool.Cache, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.Shutdown(ctx)
+}
+
+// assertJournalEmpty checks that every spooled object was removed.
+func assertJournalEmpty(t *testing.T, dir string) {
+	t.Helper()
+	files, err := ioutil.ReadDir(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("failed to read journal: %s", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected empty journal, found %d files", len(files))
+	}
+}
+
+func TestCommon(t *testing.T) {
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		backend := newGatedCache()
+		close(backend.gate)
+		return newSpool(t, backend, spool.Config{Dir: t.TempDir()})
+	})
+}
+
+func TestWriteBehind(t *testing.T) {
+	dir := t.TempDir()
+
+	backend := newGatedCache()
+	c := newSpool(t, backend, spool.Config{Dir: dir})
+
+	// the put returns before the backend stores the object
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+	cachetest.AssertMiss(t, backend.Cache, "key")
+
+	// the spooled object is served until it is uploaded
+	cachetest.AssertGet(t, c, "key", []byte("value"))
+	info := cachetest.AssertStat(t, c, "key")
+	if info.Size != 5 {
+		t.Errorf("expected size 5, got %d", info.Size)
+	}
+
+	close(backend.gate)
+	if err := shutdown(t, c, 5*time.Second); err != nil {
+		t.Fatalf("failed to shutdown spool: %s", err)
+	}
+	cachetest.AssertGet(t, backend.Cache, "key", []byte("value"))
+	assertJournalEmpty(t, dir)
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	// the backend never accepts the upload
+	c := newSpool(t, newGatedCache(), spool.Config{Dir: dir})
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+	if err := shutdown(t, c, 100*time.Millisecond); err == nil {
+		t.Fatal("expected shutdown to report the pending upload")
+	}
+
+	// the journal is replayed by the next spool
+	backend := newGatedCache()
+	close(backend.gate)
+	c = newSpool(t, backend, spool.Config{Dir: dir})
+	cachetest.AssertGet(t, c, "key", []byte("value"))
+	if err := shutdown(t, c, 5*time.Second); err != nil {
+		t.Fatalf("failed to shutdown spool: %s", err)
+	}
+	cachetest.AssertGet(t, backend.Cache, "key", []byte("value"))
+	assertJournalEmpty(t, dir)
+}
+
+func TestRetry(t *testing.T) {
+	dir := t.TempDir()
+
+	backend := newGatedCache()
+	backend.failPuts = 2
+	close(backend.gate)
+	c := newSpool(t, backend, spool.Config{Dir: dir, RetryDelay: 10 * time.Millisecond})
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if found, _ := cache.Contains(context.Background(), backend.Cache, "key"); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed upload was not retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := shutdown(t, c, 5*time.Second); err != nil {
+		t.Fatalf("failed to shutdown spool: %s", err)
+	}
+	if puts := atomic.LoadInt32(&backend.puts); puts != 3 {
+		t.Errorf("expected 3 backend puts, got %d", puts)
+	}
+	assertJournalEmpty(t, dir)
+}
+
+func TestRetryDuringShutdown(t *testing.T) {
+	dir := t.TempDir()
+
+	backend := newGatedCache()
+	backend.failPuts = 1
+	close(backend.gate)
+	c := newSpool(t, backend, spool.Config{Dir: dir, RetryDelay: 50 * time.Millisecond})
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+
+	// the failed upload is retried within the grace period
+	if err := shutdown(t, c, 5*time.Second); err != nil {
+		t.Fatalf("failed to shutdown spool: %s", err)
+	}
+	if puts := atomic.LoadInt32(&backend.puts); puts != 2 {
+		t.Errorf("expected 2 backend puts, got %d", puts)
+	}
+	cachetest.AssertGet(t, backend.Cache, "key", []byte("value"))
+	assertJournalEmpty(t, dir)
+}
+
+func TestFull(t *testing.T) {
+	dir := t.TempDir()
+
+	backend := newGatedCache()
+	c := newSpool(t, backend, spool.Config{Dir: dir, MaxSize: 1})
+	cachetest.AssertPut(t, c, "first", []byte("value"))
+
+	// the spool is full so the put waits for the backend
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Put(context.Background(), "second", bytes.NewReader([]byte("value")), cache.Metadata{ContentLength: -1})
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("expected put to wait for the backend, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(backend.gate)
+	if err := <-errs; err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+	cachetest.AssertGet(t, backend.Cache, "second", []byte("value"))
+
+	if err := shutdown(t, c, 5*time.Second); err != nil {
+		t.Fatalf("failed to shutdown spool: %s", err)
+	}
+	cachetest.AssertGet(t, backend.Cache, "first", []byte("value"))
+}
+
+func TestFullWaitsForUpload(t *testing.T) {
+	dir := t.TempDir()
+
+	backend := newGatedCache()
+	c := newSpool(t, backend, spool.Config{Dir: dir, MaxSize: 1})
+	cachetest.AssertPut(t, c, "key", []byte("old"))
+	for atomic.LoadInt32(&backend.puts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the spool is full so the put is written directly once the older
+	// object of the key is uploaded
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Put(context.Background(), "key", bytes.NewReader([]byte("new")), cache.Metadata{ContentLength: -1})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if puts := atomic.LoadInt32(&backend.puts); puts != 1 {
+		t.Fatalf("expected the put to wait for the upload, got %d backend puts", puts)
+	}
+	close(backend.gate)
+	if err := <-errs; err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+	cachetest.AssertGet(t, backend.Cache, "key", []byte("new"))
+	cachetest.AssertGet(t, c, "key", []byte("new"))
+}
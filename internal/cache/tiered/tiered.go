@@ -0,0 +1,376 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/cache"
+)
+
+// Policy determines when a put is written to the slowest tier.
+type Policy int
+
+const (
+	// WriteThrough writes to every tier before Put returns.
+	WriteThrough Policy = iota
+
+	// WriteBack writes to the faster tiers before Put returns. The object is
+	// copied to the slowest tier in the background. Objects which the faster
+	// tiers may not keep are written through.
+	WriteBack
+)
+
+// errNotKept is returned by a write-back put if none of the faster tiers kept
+// the object.
+var errNotKept = errors.New("object not kept by a faster tier")
+
+// errIncomplete is returned to a back-fill when the object is not read to
+// completion.
+var errIncomplete = errors.New("object not completely read")
+
+// Cache stacks several caches into tiers ordered from fastest to slowest.
+// Reads are served by the fastest tier containing the object. Objects found
+// in a slower tier are copied into the faster tiers as they are read. Writes
+// are sent to every tier according to the write policy.
+type Cache struct {
+	tiers  []cache.Cache
+	policy Policy
+	logger hatchet.Logger
+	wg     sync.WaitGroup
+}
+
+// New returns a cache which stacks the given tiers. The tiers are ordered
+// from fastest to slowest.
+func New(tiers []cache.Cache, policy Policy, logger hatchet.Logger) *Cache {
+	return &Cache{
+		tiers:  tiers,
+		policy: policy,
+		logger: logger,
+	}
+}
+
+// Get reads the object from the fastest tier containing it. A tier which
+// fails is skipped. The error of the first tier to fail is returned if no tier
+// has the object.
+func (c *Cache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var firstErr error
+	for i, tier := range c.tiers {
+		rdr, err := tier.Get(ctx, key)
+		if err == cache.ErrCacheMiss {
+			continue
+		} else if err != nil {
+			firstErr = c.skip(firstErr, err, key)
+			continue
+		}
+		if i == 0 {
+			return rdr, nil
+		}
+
+		// copy the object into the faster tiers as it is read
+		meta, ok := cache.ReaderMetadata(rdr)
+		if !ok {
+			info, err := tier.Stat(ctx, key)
+			if err != nil {
+				c.logError(err, key, "back-fill error")
+				return rdr, nil
+			}
+			meta = info.Metadata
+		}
+		return c.fill(key, rdr, meta, c.tiers[:i]), nil
+	}
+	return nil, missOr(firstErr)
+}
+
+// GetRange reads the range from the fastest tier containing the object. The
+// object is not copied into the faster tiers as only part of it is read.
+// Failed tiers are skipped as by Get.
+func (c *Cache) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	var firstErr error
+	for _, tier := range c.tiers {
+		rdr, err := cache.GetRange(ctx, tier, key, offset, length)
+		if err == cache.ErrCacheMiss {
+			continue
+		} else if err != nil {
+			firstErr = c.skip(firstErr, err, key)
+			continue
+		}
+		return rdr, nil
+	}
+	return nil, missOr(firstErr)
+}
+
+// Stat returns the info of the object in the fastest tier containing it.
+// Failed tiers are skipped as by Get.
+func (c *Cache) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	var firstErr error
+	for _, tier := range c.tiers {
+		info, err := tier.Stat(ctx, key)
+		if err == cache.ErrCacheMiss {
+			continue
+		} else if err != nil {
+			firstErr = c.skip(firstErr, err, key)
+			continue
+		}
+		return info, nil
+	}
+	return nil, missOr(firstErr)
+}
+
+// skip logs the error of a tier which is skipped and returns the first error.
+// Cancellation and unavailable tiers are not logged as they are expected.
+func (c *Cache) skip(firstErr, err error, key string) error {
+	if err != context.Canceled && err != context.DeadlineExceeded && err != cache.ErrUnavailable {
+		c.logError(err, key, "tier error")
+	}
+	if firstErr == nil {
+		return err
+	}
+	return firstErr
+}
+
+// missOr returns err if it is not nil and otherwise returns a miss.
+func missOr(err error) error {
+	if err != nil {
+		return err
+	}
+	return cache.ErrCacheMiss
+}
+
+// Put writes the object to the tiers according to the write policy. A
+// write-back object is written through to every tier if its length is unknown
+// or it is too large for the faster tiers, as the copy to the slowest tier is
+// read from a faster tier. An error is returned if no faster tier kept a
+// write-back object.
+func (c *Cache) Put(ctx context.Context, key string, rdr io.Reader, meta cache.Metadata) error {
+	if c.policy == WriteThrough || len(c.tiers) == 1 {
+		return putAll(ctx, c.tiers, key, rdr, meta)
+	}
+
+	last := len(c.tiers) - 1
+	if !fits(c.tiers[:last], meta.ContentLength) {
+		return putAll(ctx, c.tiers, key, rdr, meta)
+	}
+	err := putAll(ctx, c.tiers[:last], key, rdr, meta)
+	if err != nil {
+		return err
+	}
+	src := c.holder(ctx, key)
+	if src < 0 {
+		return errNotKept
+	}
+	c.writeBack(key, meta, src)
+	return nil
+}
+
+// Shutdown waits for background writes to complete. If the context expires
+// first then ctx.Err() is returned.
+func (c *Cache) Shutdown(ctx context.Context) error {
+	ch := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(ch)
+	}()
+
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// holder returns the index of the slowest of the faster tiers which holds the
+// object or -1 if none do.
+func (c *Cache) holder(ctx context.Context, key string) int {
+	for i := len(c.tiers) - 2; i >= 0; i-- {
+		ok, err := cache.Contains(ctx, c.tiers[i], key)
+		if err != nil {
+			c.logError(err, key, "write-back error")
+		} else if ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeBack copies an object from the faster tiers to the slowest tier in the
+// background. The object is read from the tier at index src, which is the
+// slowest tier known to hold it and so the most likely to still hold it, or
+// from a faster tier if it has since been evicted.
+func (c *Cache) writeBack(key string, meta cache.Metadata, src int) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ctx := context.Background()
+		last := len(c.tiers) - 1
+
+		for i := src; i >= 0; i-- {
+			rdr, err := c.tiers[i].Get(ctx, key)
+			if err == cache.ErrCacheMiss {
+				continue
+			} else if err != nil {
+				c.logError(err, key, "write-back error")
+				continue
+			}
+			err = c.tiers[last].Put(ctx, key, rdr, meta)
+			rdr.Close()
+			if err != nil {
+				c.logError(err, key, "write-back error")
+			} else {
+				c.logDebug(key, "write-back")
+			}
+			return
+		}
+		c.logError(cache.ErrCacheMiss, key, "write-back error")
+	}()
+}
+
+// fill returns a reader of rdr which copies the data read into each of the
+// given tiers. The tiers are only updated if the object is read to completion.
+func (c *Cache) fill(key string, rdr io.ReadCloser, meta cache.Metadata, tiers []cache.Cache) io.ReadCloser {
+	f := &filler{
+		ReadCloser: rdr,
+		meta:       meta,
+		done:       make(chan struct{}),
+	}
+	wg := &sync.WaitGroup{}
+	for _, tier := range tiers {
+		pipeRdr, pipeWrt := io.Pipe()
+		f.writers = append(f.writers, pipeWrt)
+		wg.Add(1)
+		go func(tier cache.Cache) {
+			defer wg.Done()
+			err := tier.Put(context.Background(), key, pipeRdr, meta)
+			// unblock the filler if the tier stopped reading early
+			pipeRdr.CloseWithError(io.ErrClosedPipe)
+			if err != nil {
+				c.logError(err, key, "back-fill error")
+			} else {
+				c.logDebug(key, "back-fill")
+			}
+		}(tier)
+	}
+
+	c.wg.Add(1)
+	go func() {
+		wg.Wait()
+		close(f.done)
+		c.wg.Done()
+	}()
+	return f
+}
+
+// filler copies data as it is read to the writers of each tier being filled.
+type filler struct {
+	io.ReadCloser
+	meta    cache.Metadata
+	writers []*io.PipeWriter
+	eof     bool
+	done    chan struct{}
+}
+
+func (f *filler) Metadata() cache.Metadata {
+	return f.meta
+}
+
+func (f *filler) Read(buf []byte) (int, error) {
+	n, err := f.ReadCloser.Read(buf)
+	if n > 0 {
+		for _, wrt := range f.writers {
+			// a tier which fails is skipped by the remaining writes
+			wrt.Write(buf[:n])
+		}
+	}
+	if err == io.EOF {
+		f.eof = true
+		for _, wrt := range f.writers {
+			wrt.Close()
+		}
+	}
+	return n, err
+}
+
+// Close the reader. Tiers being filled discard the object if it was not
+// completely read.
+func (f *filler) Close() error {
+	if !f.eof {
+		for _, wrt := range f.writers {
+			wrt.CloseWithError(errIncomplete)
+		}
+	}
+	err := f.ReadCloser.Close()
+	<-f.done
+	return err
+}
+
+// fits returns true if an object of the given length fits in one of the
+// tiers. Objects of unknown length only fit in tiers without a maximum object
+// size.
+func fits(tiers []cache.Cache, length int64) bool {
+	for _, tier := range tiers {
+		bounded, ok := tier.(cache.Bounded)
+		if !ok || (length >= 0 && length <= bounded.MaxObjectSize()) {
+			return true
+		}
+	}
+	return false
+}
+
+// putAll writes the object to each cache concurrently. An error is returned if
+// any of the caches fail.
+func putAll(ctx context.Context, caches []cache.Cache, key string, rdr io.Reader, meta cache.Metadata) error {
+	if len(caches) == 1 {
+		return caches[0].Put(ctx, key, rdr, meta)
+	}
+
+	writers := make([]io.Writer, len(caches))
+	pipes := make([]*io.PipeWriter, len(caches))
+	errs := make([]error, len(caches))
+	wg := &sync.WaitGroup{}
+	for i := range caches {
+		pipeRdr, pipeWrt := io.Pipe()
+		writers[i] = pipeWrt
+		pipes[i] = pipeWrt
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = caches[i].Put(ctx, key, pipeRdr, meta)
+			// unblock the copy if the cache stopped reading early
+			pipeRdr.CloseWithError(io.ErrClosedPipe)
+		}(i)
+	}
+
+	_, copyErr := io.Copy(io.MultiWriter(writers...), rdr)
+	for _, pipe := range pipes {
+		pipe.CloseWithError(copyErr)
+	}
+	wg.Wait()
+
+	// prefer an error from a cache as it is the likely cause of a copy error
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return copyErr
+}
+
+func (c *Cache) logDebug(key, msg string) {
+	c.logger.Log(hatchet.L{
+		"message": msg,
+		"key":     key,
+		"level":   "debug",
+	})
+}
+
+func (c *Cache) logError(err error, key, msg string) {
+	c.logger.Log(hatchet.L{
+		"message": msg,
+		"key":     key,
+		"level":   "error",
+		"error":   err,
+	})
+}
@@ -0,0 +1,216 @@
+package tiered_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zenreach/hatchet"
+	"github.com/zenreach/hydroponics/internal/cache"
+	"github.com/zenreach/hydroponics/internal/cache/cachetest"
+	"github.com/zenreach/hydroponics/internal/cache/memory"
+	"github.com/zenreach/hydroponics/internal/cache/tiered"
+)
+
+func TestCommon(t *testing.T) {
+	cachetest.Test(t, func(t *testing.T) cache.Cache {
+		return tiered.New([]cache.Cache{memory.New(4*1024*1024, 4*1024*1024), memory.New(4*1024*1024, 4*1024*1024)}, tiered.WriteThrough, hatchet.Test(t))
+	})
+}
+
+func TestWriteThrough(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{fast, slow}, tiered.WriteThrough, hatchet.Test(t))
+
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+	cachetest.AssertGet(t, fast, "key", []byte("value"))
+	cachetest.AssertGet(t, slow, "key", []byte("value"))
+}
+
+func TestWriteBack(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{fast, slow}, tiered.WriteBack, hatchet.Test(t))
+
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+	cachetest.AssertGet(t, fast, "key", []byte("value"))
+
+	shutdown(t, c)
+	cachetest.AssertGet(t, slow, "key", []byte("value"))
+}
+
+func TestWriteBackOversize(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4)
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{fast, slow}, tiered.WriteBack, hatchet.Test(t))
+	defer shutdown(t, c)
+
+	// the fast tier does not keep the object so it is written through
+	cachetest.AssertPut(t, c, "key", []byte("value"))
+	cachetest.AssertMiss(t, fast, "key")
+	cachetest.AssertGet(t, slow, "key", []byte("value"))
+}
+
+func TestWriteBackUnknownLength(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{fast, slow}, tiered.WriteBack, hatchet.Test(t))
+	defer shutdown(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	err := c.Put(ctx, "key", cachetest.NewReader([]byte("value")), cache.Metadata{
+		ContentLength: -1,
+	})
+	if err != nil {
+		t.Fatalf("failed to put value: %s", err)
+	}
+	cachetest.AssertGet(t, fast, "key", []byte("value"))
+	cachetest.AssertGet(t, slow, "key", []byte("value"))
+}
+
+func TestBackFill(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	middle := memory.New(4*1024*1024, 4*1024*1024)
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{fast, middle, slow}, tiered.WriteThrough, hatchet.Test(t))
+
+	cachetest.AssertPut(t, slow, "key", []byte("value"))
+	cachetest.AssertMiss(t, fast, "key")
+
+	// reading from the slow tier fills the faster tiers
+	cachetest.AssertGet(t, c, "key", []byte("value"))
+	cachetest.AssertGet(t, fast, "key", []byte("value"))
+	cachetest.AssertGet(t, middle, "key", []byte("value"))
+}
+
+func TestBackFillIncomplete(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{fast, slow}, tiered.WriteThrough, hatchet.Test(t))
+
+	cachetest.AssertPut(t, slow, "key", []byte("value"))
+
+	// a partial read does not fill the faster tier
+	rdr, err := c.Get(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("failed to get value: %s", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := rdr.Read(buf); err != nil {
+		t.Fatalf("failed to read value: %s", err)
+	}
+	if err := rdr.Close(); err != nil {
+		t.Fatalf("failed to close reader: %s", err)
+	}
+	cachetest.AssertMiss(t, fast, "key")
+}
+
+func TestBackFillLarge(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{fast, slow}, tiered.WriteThrough, hatchet.Test(t))
+
+	value := make([]byte, 1024*1024)
+	cachetest.AssertPut(t, slow, "key", value)
+
+	rdr, err := c.Get(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("failed to get value: %s", err)
+	}
+	if _, err := ioutil.ReadAll(rdr); err != nil {
+		t.Fatalf("failed to read value: %s", err)
+	}
+	rdr.Close()
+	cachetest.AssertGet(t, fast, "key", value)
+}
+
+func TestFailedTier(t *testing.T) {
+	broken := &brokenCache{err: errors.New("broken tier")}
+	slow := memory.New(4*1024*1024, 4*1024*1024)
+	c := tiered.New([]cache.Cache{broken, slow}, tiered.WriteThrough, hatchet.Test(t))
+	defer shutdown(t, c)
+
+	cachetest.AssertPut(t, slow, "key", []byte("value"))
+	cachetest.AssertGet(t, c, "key", []byte("value"))
+	cachetest.AssertGetRange(t, c, "key", 1, 3, []byte("alu"))
+	cachetest.AssertStat(t, c, "key")
+
+	// the failure is returned if no other tier has the object
+	_, err := c.Get(context.Background(), "missing")
+	if err != broken.err {
+		t.Errorf("expected \"%s\", got \"%s\"", broken.err, err)
+	}
+}
+
+func TestUnavailableTier(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	unavailable := &brokenCache{err: cache.ErrUnavailable}
+	c := tiered.New([]cache.Cache{fast, unavailable}, tiered.WriteThrough, hatchet.Test(t))
+	defer shutdown(t, c)
+
+	// the miss is reported as unavailable so that it is not remembered
+	_, err := c.Get(context.Background(), "missing")
+	if err != cache.ErrUnavailable {
+		t.Errorf("expected \"%s\", got \"%s\"", cache.ErrUnavailable, err)
+	}
+	cachetest.AssertContains(t, c, "missing", false)
+}
+
+func TestBackFillMetadata(t *testing.T) {
+	fast := memory.New(4*1024*1024, 4*1024*1024)
+	slow := &statCounter{Cache: memory.New(4*1024*1024, 4*1024*1024)}
+	c := tiered.New([]cache.Cache{fast, slow}, tiered.WriteThrough, hatchet.Test(t))
+	defer shutdown(t, c)
+
+	cachetest.AssertPut(t, slow, "key", []byte("value"))
+	cachetest.AssertGet(t, c, "key", []byte("value"))
+	if stats := atomic.LoadInt32(&slow.stats); stats != 0 {
+		t.Errorf("expected the back-fill to use the reader's metadata, got %d stats", stats)
+	}
+	info := cachetest.AssertStat(t, fast, "key")
+	if info.ContentLength != 5 {
+		t.Errorf("expected back-filled content length 5, got %d", info.ContentLength)
+	}
+}
+
+// brokenCache fails every operation.
+type brokenCache struct {
+	err error
+}
+
+func (c *brokenCache) Get(context.Context, string) (io.ReadCloser, error) {
+	return nil, c.err
+}
+
+func (c *brokenCache) Stat(context.Context, string) (*cache.Info, error) {
+	return nil, c.err
+}
+
+func (c *brokenCache) Put(context.Context, string, io.Reader, cache.Metadata) error {
+	return c.err
+}
+
+// statCounter counts the objects stat'd in the wrapped cache.
+type statCounter struct {
+	cache.Cache
+	stats int32
+}
+
+func (c *statCounter) Stat(ctx context.Context, key string) (*cache.Info, error) {
+	atomic.AddInt32(&c.stats, 1)
+	return c.Cache.Stat(ctx, key)
+}
+
+func shutdown(t *testing.T, c *tiered.Cache) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shutdown: %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Package digest provides the hash functions used to address CAS objects.
+package digest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// ErrMismatch is returned by a Verifier when the data does not match the
+// expected digest.
+var ErrMismatch = errors.New("digest mismatch")
+
+var (
+	// SHA256 is the SHA-256 hash function. It is the default used by Bazel.
+	SHA256 = newFunction("sha256", sha256.New)
+
+	// BLAKE3 is the BLAKE3 hash function with a 256 bit output.
+	BLAKE3 = newFunction("blake3", func() hash.Hash { return blake3.New() })
+)
+
+var functions = map[string]*Function{
+	SHA256.name: SHA256,
+	BLAKE3.name: BLAKE3,
+}
+
+// Function is a hash function used to address CAS objects. Digests are the
+// lower case hex encoding of the hash.
+type Function struct {
+	name  string
+	new   func() hash.Hash
+	size  int
+	empty string
+}
+
+func newFunction(name string, new func() hash.Hash) *Function {
+	h := new()
+	return &Function{
+		name:  name,
+		new:   new,
+		size:  h.Size() * 2,
+		empty: hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+// Parse returns the named hash function. Names are case insensitive.
+func Parse(name string) (*Function, error) {
+	f, ok := functions[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown digest function %q, valid values are %s", name, strings.Join(names(), ", "))
+	}
+	return f, nil
+}
+
+func names() []string {
+	var names []string
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name returns the name of the hash function.
+func (f *Function) Name() string {
+	return f.name
+}
+
+// String returns the name of the hash function.
+func (f *Function) String() string {
+	return f.name
+}
+
+// New returns a new hash.
+func (f *Function) New() hash.Hash {
+	return f.new()
+}
+
+// Sum returns the digest of data.
+func (f *Function) Sum(data []byte) string {
+	h := f.new()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Empty returns the digest of the empty blob.
+func (f *Function) Empty() string {
+	return f.empty
+}
+
+// Valid returns true if the digest could have been produced by the function.
+func (f *Function) Valid(digest string) bool {
+	if len(digest) != f.size {
+		return false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Verifier hashes data as it is read. At the end of the data ErrMismatch is
+// returned in place of io.EOF if the data does not match the expected digest.
+type Verifier struct {
+	rdr      io.Reader
+	hash     hash.Hash
+	digest   string
+	size     int64
+	read     int64
+	mismatch bool
+}
+
+// NewVerifier returns a reader which verifies that rdr produces data matching
+// the digest and size. The size is not checked if it is -1.
+func (f *Function) NewVerifier(rdr io.Reader, digest string, size int64) *Verifier {
+	return &Verifier{
+		rdr:    rdr,
+		hash:   f.new(),
+		digest: digest,
+		size:   size,
+	}
+}
+
+func (v *Verifier) Read(buf []byte) (int, error) {
+	n, err := v.rdr.Read(buf)
+	v.hash.Write(buf[:n])
+	v.read += int64(n)
+	if err == io.EOF {
+		if (v.size >= 0 && v.read != v.size) || hex.EncodeToString(v.hash.Sum(nil)) != v.digest {
+			v.mismatch = true
+			return n, ErrMismatch
+		}
+	}
+	return n, err
+}
+
+// Mismatch returns true if the data did not match the expected digest.
+func (v *Verifier) Mismatch() bool {
+	return v.mismatch
+}
@@ -0,0 +1,98 @@
+package digest_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/zenreach/hydroponics/internal/digest"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]*digest.Function{
+		"sha256": digest.SHA256,
+		"SHA256": digest.SHA256,
+		"blake3": digest.BLAKE3,
+	}
+	for name, want := range tests {
+		have, err := digest.Parse(name)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", name, err)
+		} else if have != want {
+			t.Errorf("expected %s for %q, got %s", want, name, have)
+		}
+	}
+
+	if _, err := digest.Parse("md5"); err == nil {
+		t.Error("expected an error for an unknown function")
+	}
+}
+
+func TestSum(t *testing.T) {
+	tests := []struct {
+		fn   *digest.Function
+		want string
+	}{
+		{digest.SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{digest.BLAKE3, "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+	}
+	for _, test := range tests {
+		have := test.fn.Sum([]byte("abc"))
+		if have != test.want {
+			t.Errorf("expected %s digest %s, got %s", test.fn, test.want, have)
+		}
+		if !test.fn.Valid(have) {
+			t.Errorf("expected %s digest %s to be valid", test.fn, have)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := map[string]bool{
+		digest.SHA256.Empty(): true,
+		"abc":                 false,
+		"BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD":  false,
+		"../7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad": false,
+	}
+	for value, want := range tests {
+		if have := digest.SHA256.Valid(value); have != want {
+			t.Errorf("expected valid %t for %q, got %t", want, value, have)
+		}
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	data := []byte("example data")
+	sum := digest.SHA256.Sum(data)
+
+	tests := []struct {
+		name     string
+		digest   string
+		size     int64
+		mismatch bool
+	}{
+		{"match", sum, int64(len(data)), false},
+		{"unknown size", sum, -1, false},
+		{"wrong size", sum, int64(len(data)) + 1, true},
+		{"wrong digest", digest.SHA256.Empty(), int64(len(data)), true},
+	}
+	for _, test := range tests {
+		ver := digest.SHA256.NewVerifier(bytes.NewReader(data), test.digest, test.size)
+		have, err := ioutil.ReadAll(ver)
+		if test.mismatch {
+			if err != digest.ErrMismatch {
+				t.Errorf("%s: expected \"%s\", got \"%v\"", test.name, digest.ErrMismatch, err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: failed to read data: %s", test.name, err)
+			}
+			if !bytes.Equal(have, data) {
+				t.Errorf("%s: expected data \"%s\", got \"%s\"", test.name, data, have)
+			}
+		}
+		if ver.Mismatch() != test.mismatch {
+			t.Errorf("%s: expected mismatch %t, got %t", test.name, test.mismatch, ver.Mismatch())
+		}
+	}
+}
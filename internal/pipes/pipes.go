@@ -24,27 +24,51 @@ type block struct {
 // to the reader by calling CloseWithError. Read may return zero bytes. It will
 // return an error when no more data is to be read. EOF indicates that all data
 // was written successfully.
+//
+// A pipe may be bounded in size. A bounded pipe blocks calls to WriteAt while
+// the amount of unread data exceeds the bound. Writes which extend the data
+// immediately available to the reader are always accepted so that the reader
+// can make progress.
 type BlockPipe struct {
 	buffer   map[int64]*block // block buffer, holds blocks that haven't been read
 	position int64            // current position of the reader
 	current  *block           // current block being read
 	err      error            // error to return on read
+	size     int64            // maximum number of unread bytes, 0 if unbounded
+	unread   int64            // number of bytes written but not yet read
 	cond     *sync.Cond
 }
 
-// NewBlocks creates a new block pipe.
+// NewBlocks creates a new unbounded block pipe.
 func NewBlocks() *BlockPipe {
+	return NewBoundedBlocks(0)
+}
+
+// NewBoundedBlocks creates a new block pipe which holds at most size bytes of
+// unread data. A size less than or equal to zero creates an unbounded pipe.
+func NewBoundedBlocks(size int) *BlockPipe {
+	if size < 0 {
+		size = 0
+	}
 	return &BlockPipe{
 		buffer: make(map[int64]*block),
+		size:   int64(size),
 		cond:   sync.NewCond(&sync.Mutex{}),
 	}
 }
 
-// WriteAt writes a block of data at the given offset. It always returns the
-// length of buf and nil.
+// WriteAt writes a block of data at the given offset. It returns the length of
+// buf and nil on success. A bounded pipe blocks until the block fits in the
+// buffer. If the pipe is closed before the block is written then 0 and
+// io.ErrClosedPipe are returned.
 func (p *BlockPipe) WriteAt(buf []byte, offset int64) (int, error) {
 	p.cond.L.Lock()
-	if p.buffer == nil {
+	for p.err == nil && p.isFull() && offset != p.frontier() {
+		p.cond.Wait()
+	}
+	if p.err != nil {
+		p.cond.L.Unlock()
+		return 0, io.ErrClosedPipe
 	}
 	blk := &block{
 		position: offset,
@@ -52,11 +76,31 @@ func (p *BlockPipe) WriteAt(buf []byte, offset int64) (int, error) {
 	}
 	copy(blk.data, buf)
 	p.buffer[offset] = blk
+	p.unread += int64(len(buf))
 	p.cond.L.Unlock()
 	p.cond.Broadcast()
 	return len(buf), nil
 }
 
+// isFull returns true if the pipe is bounded and holds at least its maximum
+// amount of unread data.
+func (p *BlockPipe) isFull() bool {
+	return p.size > 0 && p.unread >= p.size
+}
+
+// frontier returns the offset immediately following the data that is
+// contiguous with the reader's current position.
+func (p *BlockPipe) frontier() int64 {
+	pos := p.position
+	if p.current != nil {
+		pos = p.current.position + int64(len(p.current.data))
+	}
+	for p.buffer[pos] != nil {
+		pos += int64(len(p.buffer[pos].data))
+	}
+	return pos
+}
+
 // Read up to len(buf) bytes into buf. Blocks until data is ready to be read.
 // Returns the number of bytes read and a nil error on success. Returns 0 and
 // io.EOF when no more bytes are available. If CloseWithError is called then
@@ -90,6 +134,11 @@ func (p *BlockPipe) Read(buf []byte) (int, error) {
 	}
 	copy(buf[0:copySize], p.current.data[blkOffset:blkOffset+copySize])
 	p.position += int64(copySize)
+	p.unread -= int64(copySize)
+	if p.size > 0 {
+		// wake writers waiting for buffer space
+		p.cond.Broadcast()
+	}
 	return copySize, nil
 }
 
@@ -146,3 +195,19 @@ func (p *BlockPipe) Close() error {
 	p.CloseWithError(io.EOF)
 	return nil
 }
+
+// CloseRead closes the pipe when the reader is finished with it. Buffered
+// blocks are discarded. Blocked and future calls to WriteAt return
+// io.ErrClosedPipe so that the writer is not left waiting on the reader.
+func (p *BlockPipe) CloseRead() error {
+	p.cond.L.Lock()
+	if p.err == nil || p.err == io.EOF {
+		p.err = io.ErrClosedPipe
+	}
+	p.buffer = make(map[int64]*block)
+	p.current = nil
+	p.unread = 0
+	p.cond.L.Unlock()
+	p.cond.Broadcast()
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/zenreach/hydroponics/internal/pipes"
 )
@@ -61,6 +62,60 @@ func TestIncompleteWrites(t *testing.T) {
 	}
 }
 
+func TestBoundedReadMultipleBlocks(t *testing.T) {
+	want := []byte("hello world")
+	blocks := [][]byte{[]byte("hel"), []byte("lo "), []byte("wor"), []byte("ld")}
+	pipe := pipes.NewBoundedBlocks(3)
+
+	go writeBlocks(t, pipe, blocks)
+	assertRead(t, pipe, want)
+}
+
+func TestBoundedWriteBlocks(t *testing.T) {
+	pipe := pipes.NewBoundedBlocks(2)
+	pipe.WriteAt([]byte("he"), 0)
+
+	// the pipe is full so an out of order write must wait for the reader
+	written := make(chan struct{})
+	go func() {
+		pipe.WriteAt([]byte("o"), 4)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("out of order write did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assertReadOnce(t, pipe, []byte("he"))
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("out of order write did not finish after the read")
+	}
+
+	// a write which extends the readable data is always accepted
+	pipe.WriteAt([]byte("ll"), 2)
+	pipe.Close()
+	assertRead(t, pipe, []byte("llo"))
+}
+
+func TestBoundedWriteClosed(t *testing.T) {
+	pipe := pipes.NewBoundedBlocks(1)
+	pipe.WriteAt([]byte("he"), 0)
+
+	errs := make(chan error)
+	go func() {
+		_, err := pipe.WriteAt([]byte("o"), 4)
+		errs <- err
+	}()
+	pipe.CloseWithError(errors.New("oops!"))
+
+	if err := <-errs; err != io.ErrClosedPipe {
+		t.Errorf("incorrect error: \"%s\" != \"%s\"", err, io.ErrClosedPipe)
+	}
+}
+
 func writeBlocks(t *testing.T, wr *pipes.BlockPipe, blocks [][]byte) {
 	wg := &sync.WaitGroup{}
 	wg.Add(len(blocks))
@@ -122,3 +177,25 @@ func assertReadOnce(t *testing.T, rdr io.Reader, expect []byte) {
 	}
 	assertBytesEqual(t, buf, expect)
 }
+
+func TestCloseRead(t *testing.T) {
+	pipe := pipes.NewBoundedBlocks(1)
+	pipe.WriteAt([]byte("he"), 0)
+
+	errs := make(chan error)
+	go func() {
+		_, err := pipe.WriteAt([]byte("o"), 4)
+		errs <- err
+	}()
+	pipe.CloseRead()
+
+	if err := <-errs; err != io.ErrClosedPipe {
+		t.Errorf("incorrect error: \"%s\" != \"%s\"", err, io.ErrClosedPipe)
+	}
+	if _, err := pipe.WriteAt([]byte("ll"), 2); err != io.ErrClosedPipe {
+		t.Errorf("incorrect error: \"%s\" != \"%s\"", err, io.ErrClosedPipe)
+	}
+	if _, err := pipe.Read(make([]byte, 5)); err != io.ErrClosedPipe {
+		t.Errorf("incorrect error: \"%s\" != \"%s\"", err, io.ErrClosedPipe)
+	}
+}
@@ -0,0 +1,39 @@
+// Package tracing provides helpers for tracing cache operations with
+// OpenTelemetry. Spans are sent to the globally registered tracer provider.
+package tracing
+
+import (
+	"context"
+
+	"github.com/zenreach/hydroponics/internal/cache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation is the name of the tracer used by the cache.
+const instrumentation = "github.com/zenreach/hydroponics"
+
+// Start a span which is a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End a span. The error is recorded if it is not nil. A cache miss is not
+// treated as an error.
+func End(span trace.Span, err error) {
+	if cache.IsMiss(err) {
+		span.SetAttributes(attribute.Bool("cache.miss", true))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Detach returns a context which carries the span of ctx but is never
+// cancelled. It is used to trace background work started by a request.
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}